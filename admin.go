@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// appView app returned by the admin API, its parsed configuration and its last tick
+type appView struct {
+	Key      string          `json:"key"`
+	Resource string          `json:"resource"`
+	Config   appConfig       `json:"config"`
+	Status   *appObservation `json:"status,omitempty"`
+}
+
+// appConfig configuration of an app parsed from its annotations, the limits are the ones outside of the schedule windows
+type appConfig struct {
+	Backend           string           `json:"backend"`
+	Cluster           string           `json:"cluster"`
+	CredentialsSecret string           `json:"credentialsSecret,omitempty"`
+	Queues            []queueConfig    `json:"queues"`
+	QueuesAggregation string           `json:"queuesAggregation"`
+	MinWorkers        int32            `json:"minWorkers"`
+	MaxWorkers        int32            `json:"maxWorkers"`
+	MessagesPerWorker int32            `json:"messagesPerWorker"`
+	RatePerWorker     float64          `json:"ratePerWorker,omitempty"`
+	TargetDrainTime   string           `json:"targetDrainTime,omitempty"`
+	Steps             int32            `json:"steps"`
+	Offset            int32            `json:"offset"`
+	Schedule          []ScheduleWindow `json:"schedule,omitempty"`
+	Behavior          *ScalingBehavior `json:"behavior,omitempty"`
+	Override          bool             `json:"override"`
+	SafeUnscale       bool             `json:"safeUnscale"`
+	CoolDownDelay     string           `json:"cooldownDelay"`
+	ScaleToZero       bool             `json:"scaleToZero"`
+	IdleDelay         string           `json:"idleDelay,omitempty"`
+	ActivationWorkers int32            `json:"activationWorkers,omitempty"`
+	DryRun            bool             `json:"dryRun"`
+	Paused            bool             `json:"paused"`
+	PinReplicas       *int32           `json:"pinReplicas,omitempty"`
+	PinUntil          *time.Time       `json:"pinUntil,omitempty"`
+	FailurePolicy     string           `json:"failurePolicy"`
+	FailureThreshold  int32            `json:"failureThreshold"`
+	FallbackReplicas  int32            `json:"fallbackReplicas,omitempty"`
+	RabbitScaler      string           `json:"rabbitScaler,omitempty"`
+}
+
+type queueConfig struct {
+	Vhost             string `json:"vhost"`
+	Name              string `json:"name"`
+	Pattern           bool   `json:"pattern,omitempty"`
+	MessagesPerWorker int32  `json:"messagesPerWorker"`
+}
+
+// appObservation last tick of an app, copied by the worker that scaled it
+// so the admin API never reads an app while it's scaled
+type appObservation struct {
+	ObservedAt          time.Time          `json:"observedAt"`
+	Replicas            int32              `json:"replicas"`
+	ReadyReplicas       int32              `json:"readyReplicas"`
+	DesiredReplicas     int32              `json:"desiredReplicas"`
+	QueueMessages       int32              `json:"queueMessages"`
+	QueueConsumers      int32              `json:"queueConsumers"`
+	MinWorkers          int32              `json:"minWorkers"`
+	MaxWorkers          int32              `json:"maxWorkers"`
+	Offset              int32              `json:"offset"`
+	ScheduleWindow      string             `json:"scheduleWindow,omitempty"`
+	Queues              []queueObservation `json:"queues,omitempty"`
+	Decision            string             `json:"decision"`
+	Reason              string             `json:"reason"`
+	Error               string             `json:"error,omitempty"`
+	ConsecutiveFailures int32              `json:"consecutiveFailures"`
+	LastScaleTime       *time.Time         `json:"lastScaleTime,omitempty"`
+}
+
+type queueObservation struct {
+	Vhost     string `json:"vhost"`
+	Name      string `json:"name"`
+	Matches   int    `json:"matches,omitempty"`
+	Messages  int32  `json:"messages"`
+	Consumers int32  `json:"consumers"`
+	Workers   int32  `json:"workers"`
+}
+
+// rejectedApp workload enabled for autoscaling whose configuration can't be parsed
+type rejectedApp struct {
+	Key        string    `json:"key"`
+	Error      string    `json:"error"`
+	RejectedAt time.Time `json:"rejectedAt"`
+}
+
+// serveAdmin serves the admin API, to inspect the apps and explain their decisions
+func serveAdmin(address string, a *Autoscaler) {
+	klog.Infof("Serving admin API on %s", address)
+	if err := http.ListenAndServe(address, a.adminHandler()); err != nil {
+		klog.Errorf("Admin server stopped (%s)", err)
+	}
+}
+
+// adminHandler handles /apps, /apps/{key} (ex: /apps/deployments.apps/namespace/name) and /rejected.
+// The pause and pin of an app are set with a POST on /apps/{key}/{action}
+func (a *Autoscaler) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.appViews())
+	})
+
+	mux.HandleFunc("/apps/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/apps/")
+
+		if r.Method == http.MethodPost {
+			a.serveOverride(w, r, key)
+			return
+		}
+
+		for _, view := range a.appViews() {
+			if view.Key == key {
+				writeJSON(w, view)
+				return
+			}
+		}
+
+		http.Error(w, "app "+key+" not found", http.StatusNotFound)
+	})
+
+	mux.HandleFunc("/rejected", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.rejectedApps())
+	})
+
+	return mux
+}
+
+// serveOverride pauses, resumes, pins or unpins an app (ex: /apps/{key}/pin?replicas=10&for=1h).
+// The change is patched on the workload annotations or the RabbitScaler spec, the leader applies it on its next tick
+func (a *Autoscaler) serveOverride(w http.ResponseWriter, r *http.Request, path string) {
+	if len(a.adminToken) == 0 {
+		http.Error(w, "the admin token is not set, pause and pin are disabled", http.StatusForbidden)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.adminToken)) != 1 {
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	separator := strings.LastIndex(path, "/")
+	if separator < 0 {
+		http.Error(w, "missing action, expected pause, resume, pin or unpin", http.StatusNotFound)
+		return
+	}
+
+	key, action := path[:separator], path[separator+1:]
+	var values map[string]interface{}
+
+	switch action {
+	case "pause":
+		values = map[string]interface{}{Paused: true}
+	case "resume":
+		values = map[string]interface{}{Paused: nil}
+	case "pin":
+		replicas, until, err := parsePin(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values = map[string]interface{}{PinReplicas: replicas, PinUntil: until.UTC().Format(time.RFC3339)}
+	case "unpin":
+		values = map[string]interface{}{PinReplicas: nil, PinUntil: nil}
+	default:
+		http.Error(w, "unknown action "+action+", expected pause, resume, pin or unpin", http.StatusNotFound)
+		return
+	}
+
+	patch, ok, err := a.patchManual(key, values)
+	if !ok {
+		http.Error(w, "app "+key+" not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		klog.Errorf("Error during the %s of %s through the admin API (%s)", action, key, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	klog.Infof("%s %s through the admin API (%s)", key, action, r.URL.RawQuery)
+	writeJSON(w, patch)
+}
+
+// parsePin reads the replicas and the end of the pin, set with until (RFC 3339) or for (duration)
+func parsePin(r *http.Request, now time.Time) (int32, time.Time, error) {
+	query := r.URL.Query()
+
+	replicas, err := strconv.ParseInt(query.Get("replicas"), 10, 32)
+	if err != nil || replicas < 0 {
+		return 0, time.Time{}, errors.New("replicas must be a positive int")
+	}
+
+	if duration := query.Get("for"); len(duration) > 0 {
+		duration, err := time.ParseDuration(duration)
+		if err != nil || duration <= 0 {
+			return 0, time.Time{}, errors.New("for must be a positive duration (ex: 30m)")
+		}
+		return int32(replicas), now.Add(duration), nil
+	}
+
+	until, err := time.Parse(time.RFC3339, query.Get("until"))
+	if err != nil || !until.After(now) {
+		return 0, time.Time{}, errors.New("until must be a future RFC 3339 time (ex: 2019-01-02T15:04:05Z), or use for")
+	}
+
+	return int32(replicas), until, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// appViews returns the registered apps sorted by key, the configuration of an app never changes once created
+func (a *Autoscaler) appViews() []appView {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	views := make([]appView, 0, len(a.apps))
+	for key, app := range a.apps {
+		view := appView{
+			Key:      key,
+			Resource: app.ref.resource.GroupResource().String(),
+			Config:   app.config(),
+			Status:   a.observations[key],
+		}
+
+		views = append(views, view)
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Key < views[j].Key })
+	return views
+}
+
+// rejectedApps returns the rejected workloads sorted by key
+func (a *Autoscaler) rejectedApps() []rejectedApp {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rejected := make([]rejectedApp, 0, len(a.rejected))
+	for _, app := range a.rejected {
+		rejected = append(rejected, app)
+	}
+
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].Key < rejected[j].Key })
+	return rejected
+}
+
+// reject records a workload whose configuration can't be parsed
+func (a *Autoscaler) reject(key string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rejected == nil {
+		a.rejected = make(map[string]rejectedApp)
+	}
+	a.rejected[key] = rejectedApp{Key: key, Error: err.Error(), RejectedAt: time.Now()}
+}
+
+// observe records the last tick of the app, while it's still registered
+func (a *Autoscaler) observe(app *App, queueErr error) {
+	observation := app.observation(queueErr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.apps[app.key]; !ok {
+		return
+	}
+
+	if a.observations == nil {
+		a.observations = make(map[string]*appObservation)
+	}
+	a.observations[app.key] = observation
+}
+
+func (app *App) config() appConfig {
+	config := appConfig{
+		Backend:           app.backend,
+		Cluster:           app.cluster,
+		CredentialsSecret: app.credentials,
+		QueuesAggregation: app.aggregation,
+		MinWorkers:        app.defaultLimits.minWorkers,
+		MaxWorkers:        app.defaultLimits.maxWorkers,
+		MessagesPerWorker: app.messagesPerWorker,
+		RatePerWorker:     app.ratePerWorker,
+		Steps:             app.steps,
+		Behavior:          app.behavior,
+		Offset:            app.defaultLimits.offset,
+		Override:          app.overrideLimits,
+		SafeUnscale:       app.safeUnscale,
+		CoolDownDelay:     app.coolDownDelay.String(),
+		ScaleToZero:       app.scaleToZero,
+		DryRun:            app.dryRun,
+		Paused:            app.paused,
+		PinReplicas:       app.pinReplicas,
+		FailurePolicy:     app.failurePolicy,
+		FailureThreshold:  app.failureThreshold,
+		FallbackReplicas:  app.fallbackReplicas,
+	}
+
+	for _, window := range app.schedule {
+		config.Schedule = append(config.Schedule, window.ScheduleWindow)
+	}
+
+	for _, queue := range app.queues {
+		config.Queues = append(config.Queues, queueConfig{
+			Vhost:             queue.vhost,
+			Name:              queue.name,
+			Pattern:           queue.pattern != nil,
+			MessagesPerWorker: queue.messagesPerWorker,
+		})
+	}
+
+	if app.targetDrainTime > 0 {
+		config.TargetDrainTime = app.targetDrainTime.String()
+	}
+
+	if app.scaleToZero {
+		config.IdleDelay = app.idleDelay.String()
+		config.ActivationWorkers = app.activationWorkers
+	}
+
+	if app.pinReplicas != nil {
+		pinUntil := app.pinUntil
+		config.PinUntil = &pinUntil
+	}
+
+	if app.scaler != nil {
+		config.RabbitScaler = app.scaler.key()
+	}
+
+	return config
+}
+
+func (app *App) observation(queueErr error) *appObservation {
+	observation := &appObservation{
+		ObservedAt:          time.Now(),
+		Replicas:            app.replicas,
+		ReadyReplicas:       app.readyWorkers,
+		DesiredReplicas:     app.desiredReplicas,
+		QueueMessages:       app.queueSize,
+		QueueConsumers:      app.consumers,
+		MinWorkers:          app.minWorkers,
+		MaxWorkers:          app.maxWorkers,
+		Offset:              app.offset,
+		ScheduleWindow:      app.window,
+		Decision:            app.decision,
+		Reason:              app.reason,
+		ConsecutiveFailures: app.failures,
+	}
+
+	if queueErr != nil {
+		observation.Error = queueErr.Error()
+	}
+
+	for _, queue := range app.queues {
+		observation.Queues = append(observation.Queues, queueObservation{
+			Vhost:     queue.vhost,
+			Name:      queue.name,
+			Matches:   queue.matches,
+			Messages:  queue.messages,
+			Consumers: queue.consumers,
+			Workers:   queue.workers,
+		})
+	}
+
+	if !app.lastScaleTime.IsZero() {
+		lastScaleTime := app.lastScaleTime
+		observation.LastScaleTime = &lastScaleTime
+	}
+
+	return observation
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakePatches records the merge patches, the other calls of the dynamic client are not implemented
+type fakePatches struct {
+	dynamic.Interface
+	dynamic.NamespaceableResourceInterface
+	resource  string
+	namespace string
+	patches   []string
+}
+
+func (f *fakePatches) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	f.resource = resource.Resource
+	return f
+}
+
+func (f *fakePatches) Namespace(namespace string) dynamic.ResourceInterface {
+	f.namespace = namespace
+	return f
+}
+
+func (f *fakePatches) Patch(name string, pt types.PatchType, data []byte, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if pt != types.MergePatchType {
+		return nil, fmt.Errorf("unexpected patch type %s", pt)
+	}
+	f.patches = append(f.patches, f.resource+"/"+f.namespace+"/"+name+" "+string(data))
+	return &unstructured.Unstructured{}, nil
+}
+
+func get(t *testing.T, server *httptest.Server, path string, value interface{}) int {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if value != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	hub := &Autoscaler{
+		apps:      make(map[string]*App),
+		snapshots: newSnapshotter(queueSources{"static": {DefaultCluster: staticSource{{Name: "queue", Messages: 4, Consumers: 2}}}}, 0),
+		recorder:  record.NewFakeRecorder(100),
+	}
+	deployment := &workload{
+		resource:      schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		namespace:     "namespace",
+		name:          "worker",
+		replicas:      2,
+		readyReplicas: 2,
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/backend":     "static",
+			"k8s-rmq-autoscaler/min-workers": "1",
+			"k8s-rmq-autoscaler/max-workers": "2",
+		},
+	}
+	invalid := &workload{
+		resource:    deployment.resource,
+		namespace:   "namespace",
+		name:        "invalid",
+		annotations: map[string]string{"k8s-rmq-autoscaler/enable": "true"},
+	}
+
+	hub.addWorkload(deployment)
+	hub.addWorkload(invalid)
+
+	server := httptest.NewServer(hub.adminHandler())
+	defer server.Close()
+
+	var apps []appView
+	get(t, server, "/apps", &apps)
+
+	if len(apps) != 1 || apps[0].Key != "deployments.apps/namespace/worker" || apps[0].Config.MaxWorkers != 2 || apps[0].Status != nil {
+		t.Error("Expected the worker app without status, got ", apps)
+	}
+
+	snapshot := hub.snapshots.refresh(context.Background(), snapshotKeys(hub.listApps()))
+	hub.autoscale(context.Background(), hub.apps[deployment.key()], &fakeScales{replicas: 2}, snapshot)
+
+	var view appView
+	get(t, server, "/apps/deployments.apps/namespace/worker", &view)
+
+	if view.Status == nil || view.Status.Decision != decisionNone || view.Status.QueueMessages != 4 || view.Status.Queues[0].Workers != 4 {
+		t.Fatal("Expected the last tick of the app, got ", view.Status)
+	}
+
+	if view.Status.Reason != "at the max workers (2), 2 more workers needed (queue: 4)" {
+		t.Error("Unexpected reason ", view.Status.Reason)
+	}
+
+	if code := get(t, server, "/apps/deployments.apps/namespace/missing", nil); code != http.StatusNotFound {
+		t.Error("Expected 404, got ", code)
+	}
+
+	var rejected []rejectedApp
+	get(t, server, "/rejected", &rejected)
+
+	if len(rejected) != 1 || rejected[0].Key != "deployments.apps/namespace/invalid" || rejected[0].Error == "" {
+		t.Error("Expected the invalid app, got ", rejected)
+	}
+
+	// A fixed workload is no longer rejected
+	invalid.annotations = deployment.annotations
+	hub.addWorkload(invalid)
+	get(t, server, "/rejected", &rejected)
+
+	if len(rejected) != 0 {
+		t.Error("Expected no rejected app, got ", rejected)
+	}
+
+	// Pause and pin are patched on the workload annotations
+	client := &fakePatches{}
+	hub.clients = &clients{dynamic: client}
+
+	token := "Bearer secret"
+	post := func(path string) int {
+		request, err := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", token)
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/apps/deployments.apps/namespace/worker/pause"); code != http.StatusForbidden {
+		t.Error("Pause should be disabled without admin token, got ", code)
+	}
+
+	hub.adminToken = "secret"
+	token = "Bearer wrong"
+
+	if code := post("/apps/deployments.apps/namespace/worker/pause"); code != http.StatusUnauthorized || len(client.patches) != 0 {
+		t.Error("Expected 401 with a wrong token, got ", code)
+	}
+
+	token = "Bearer secret"
+
+	if code := post("/apps/deployments.apps/namespace/worker/pause"); code != http.StatusOK || client.patches[0] != "deployments/namespace/worker "+`{"metadata":{"annotations":{"k8s-rmq-autoscaler/paused":"true"}}}` {
+		t.Error("App should be paused, got ", code, client.patches)
+	}
+
+	if code := post("/apps/deployments.apps/namespace/worker/pin?replicas=5&until=2100-01-01T00:00:00Z"); code != http.StatusOK || client.patches[1] != "deployments/namespace/worker "+`{"metadata":{"annotations":{"k8s-rmq-autoscaler/pin-replicas":"5","k8s-rmq-autoscaler/pin-until":"2100-01-01T00:00:00Z"}}}` {
+		t.Error("App should be pinned, got ", code, client.patches)
+	}
+
+	for path, expected := range map[string]int{
+		"/apps/deployments.apps/namespace/worker/pin?replicas=5&until=2000-01-01T00:00:00Z": http.StatusBadRequest,
+		"/apps/deployments.apps/namespace/worker/pin?replicas=-1&for=1h":                    http.StatusBadRequest,
+		"/apps/deployments.apps/namespace/worker/scale":                                     http.StatusNotFound,
+		"/apps/deployments.apps/namespace/missing/pause":                                    http.StatusNotFound,
+	} {
+		if code := post(path); code != expected {
+			t.Error("Expected ", expected, " for ", path, ", got ", code)
+		}
+	}
+
+	post("/apps/deployments.apps/namespace/worker/resume")
+	post("/apps/deployments.apps/namespace/worker/unpin")
+
+	if len(client.patches) != 4 || client.patches[2] != "deployments/namespace/worker "+`{"metadata":{"annotations":{"k8s-rmq-autoscaler/paused":null}}}` || client.patches[3] != "deployments/namespace/worker "+`{"metadata":{"annotations":{"k8s-rmq-autoscaler/pin-replicas":null,"k8s-rmq-autoscaler/pin-until":null}}}` {
+		t.Error("Annotations should be removed, got ", client.patches)
+	}
+
+	// The spec of a RabbitScaler is patched instead
+	hub.apps[deployment.key()].scaler = &RabbitScaler{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "scaler"}}
+
+	if code := post("/apps/deployments.apps/namespace/worker/pause"); code != http.StatusOK || client.patches[4] != "rabbitscalers/namespace/scaler "+`{"spec":{"paused":true}}` {
+		t.Error("RabbitScaler should be paused, got ", code, client.patches)
+	}
+
+	hub.removeApp(deployment.key())
+	get(t, server, "/apps", &apps)
+
+	if len(apps) != 1 || len(hub.observations) != 0 {
+		t.Error("Removed app should be forgotten, got ", apps)
+	}
+}
@@ -6,16 +6,20 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync"
 	"time"
 
-	"k8s.io/api/apps/v1beta1"
-	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/scale"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 )
 
 const (
-	// AnnotationPrefix Prefix that will be use to find the corrects annotation on deployment
+	// AnnotationPrefix Prefix that will be use to find the corrects annotation on workloads
 	AnnotationPrefix = "k8s-rmq-autoscaler/"
 	// Enable Annotation key used to enable the scaler
 	Enable = "enable"
@@ -23,6 +27,21 @@ const (
 	Queue = "queue"
 	// Vhost Annotation Key used to set rmq vhost where the queue can be found
 	Vhost = "vhost"
+	// QueuePattern Annotation Key used to watch all the queues of the vhost matching a glob (ex: orders.shard-*)
+	// or a regex between slashes (ex: /^orders\.shard-[0-9]+$/). Messages and consumers of the matching queues are added
+	QueuePattern = "queue-pattern"
+	// Backend Annotation Key used to set the broker backend where the queues can be found (Default: rabbitmq)
+	Backend = "backend"
+	// Cluster Annotation Key used to set the cluster of the backend where the queues can be found (Default: default)
+	Cluster = "cluster"
+	// CredentialsSecret Annotation Key used to set a Secret of the workload namespace holding the username and password
+	// used to read the queues, instead of the credentials of the cluster. The Secret must be of type kubernetes.io/basic-auth
+	CredentialsSecret = "credentials-secret"
+	// Queues Annotation Key used to set other queues consumed by the workers,
+	// formatted as `vhost/queue[:messages-per-worker]` and separated by commas. Queue and vhost are optional when set
+	Queues = "queues"
+	// QueuesAggregation Annotation Key used to set how the workers needed by each queue are combined, sum or max (Default: sum)
+	QueuesAggregation = "queues-aggregation"
 	// MinWorkers Annotation Key used to set the minimum amount of worker to scale down
 	MinWorkers = "min-workers"
 	// MaxWorkers Annotation Key used to set the maximum amount of worker to scale up
@@ -45,31 +64,109 @@ const (
 	// CoolDownDelay Annotation Key used to specifies how long the autoscaler has to wait before
 	// another downscale operation can be performed after the current one has completed
 	CoolDownDelay = "cooldown-delay"
+	// RatePerWorker Annotation Key used to set the messages per second a worker can handle.
+	// When set, the workers are sized from the publish rate of the queue, the backlog is still drained (Default: disabled)
+	RatePerWorker = "rate-per-worker"
+	// TargetDrainTime Annotation Key used to set the time the workers should take to empty the queue.
+	// The workers are sized from the ack rate of the current consumers instead of messages-per-worker (Default: disabled)
+	TargetDrainTime = "target-drain-time"
+	// ScaleToZero Annotation Key used to scale the workload to 0 replicas when the queue stays empty (Default: false)
+	// The first message in queue then wakes the workload up with activation-workers replicas
+	ScaleToZero = "scale-to-zero"
+	// IdleDelay Annotation Key used to set how long the queue has to be empty before scaling to zero (Default: 5m0s)
+	IdleDelay = "idle-delay"
+	// ActivationWorkers Annotation Key used to set the replicas used to wake up a workload scaled to zero
+	// (Default: min-workers, at least 1)
+	ActivationWorkers = "activation-workers"
+	// Paused Annotation Key used to freeze the replicas, the autoscaler doesn't scale the workload while it's paused (Default: false)
+	Paused = "paused"
+	// PinReplicas Annotation Key used to hold a fixed replica count until pin-until, whatever the queue and the limits
+	PinReplicas = "pin-replicas"
+	// PinUntil Annotation Key used to set when the pinned replicas are handed back to the autoscaler (RFC 3339, ex: 2019-01-02T15:04:05Z)
+	PinUntil = "pin-until"
+	// DryRun Annotation Key used to only record the scaling decisions, the replicas are never updated (Default: false)
+	DryRun = "dry-run"
+	// FailurePolicy Annotation Key used to set what happens when the queues can't be read, hold, fallback or min (Default: hold)
+	FailurePolicy = "failure-policy"
+	// FailureThreshold Annotation Key used to set the consecutive failed ticks before the failure policy is applied (Default: 3)
+	FailureThreshold = "failure-threshold"
+	// FallbackReplicas Annotation Key used to set the replicas of the fallback failure policy
+	FallbackReplicas = "fallback-replicas"
+	// Behavior Annotation Key used to set the scaling rules of each direction, formatted as a YAML or JSON object
+	// like the behavior of an autoscaling/v2 HorizontalPodAutoscaler: policies per period and stabilization window
+	Behavior = "behavior"
+	// Schedule Annotation Key used to set the windows, formatted as a YAML or JSON list, where other min-workers,
+	// max-workers and offset apply. The first open window of the list is used
+	Schedule = "schedule"
 
-	missingPropertyError = "deployment: %s has no property `%s` not filled"
-	notAnIntError        = "deployment: %s property `%s` is not an int (ex: 1)"
-	notAnBool            = "deployment: %s property `%s` is not an boolean (ex: true)"
-	notADuration         = "deployment: %s property `%s` is not an duration (ex: 5m0s)"
+	decisionUp                 = "up"
+	decisionDown               = "down"
+	decisionNone               = "none"
+	decisionUnstable           = "unstable"
+	decisionCoolDown           = "cooldown"
+	decisionSafeUnscaleBlocked = "safe-unscale-blocked"
+
+	missingPropertyError = "workload: %s has no property `%s` not filled"
+	notAnIntError        = "workload: %s property `%s` is not an int (ex: 1)"
+	notAnBool            = "workload: %s property `%s` is not an boolean (ex: true)"
+	notADuration         = "workload: %s property `%s` is not an duration (ex: 5m0s)"
+	notAFloat            = "workload: %s property `%s` is not a float (ex: 2.5)"
+	notPositiveError     = "workload: %s property `%s` must be greater than 0"
+	negativeError        = "workload: %s property `%s` must not be negative"
+	minGreaterThanMax    = "workload: %s property `%s` must be lower or equal to `%s`"
+	notInListError       = "workload: %s property `%s` must be one of %v"
+	notATime             = "workload: %s property `%s` is not a RFC 3339 time (ex: 2019-01-02T15:04:05Z)"
 )
 
 // Autoscaler struct that will be used to received events from discovery
 type Autoscaler struct {
-	add    chan *v1beta1.Deployment
-	delete chan *v1beta1.Deployment
-	apps   map[string]*App
-	client *kubernetes.Clientset
-	rmq    *rmq
+	add           chan *workload
+	delete        chan *workload
+	addScaler     chan *RabbitScaler
+	deleteScaler  chan *RabbitScaler
+	apps          map[string]*App
+	scalers       map[string]*RabbitScaler
+	scalerTargets map[string]string
+	mu            sync.Mutex
+	clients       *clients
+	// resources watched by the informers, the target of a RabbitScaler must be one of them
+	resources  map[schema.GroupVersionResource]bool
+	snapshots  *snapshotter
+	workers    int
+	appTimeout time.Duration
+	// dryRun the decisions of all the apps are only recorded
+	dryRun bool
+	// observations last tick of each app and rejected workloads, shown by the admin API
+	observations map[string]*appObservation
+	rejected     map[string]rejectedApp
+	// unresolvedScalers RabbitScalers whose scaleTargetRef could not be found, resolved again every scalerRetryPeriod
+	unresolvedScalers map[string]*RabbitScaler
+	// scalerWorkloads last workload of each RabbitScaler target with its own annotations, added again when it's released
+	scalerWorkloads map[string]*workload
+	// validities Valid conditions of the RabbitScalers waiting to be written by the leader
+	validities      map[string]scalerValidity
+	validityUpdates chan struct{}
+	// adminToken bearer token required by the pause and pin of the admin API, disabled when empty
+	adminToken string
+	recorder   record.EventRecorder
 }
 
-// App struct used to store information about a deployment
+// App struct used to store information about a workload
 type App struct {
-	ref               *v1beta1.Deployment
+	ref               *workload
 	key               string
 	queue             string
 	vhost             string
+	backend           string
+	cluster           string
+	credentials       string
+	queues            []*appQueue
+	aggregation       string
 	minWorkers        int32
 	maxWorkers        int32
 	messagesPerWorker int32
+	ratePerWorker     float64
+	targetDrainTime   time.Duration
 	readyWorkers      int32
 	replicas          int32
 	steps             int32
@@ -77,81 +174,381 @@ type App struct {
 	overrideLimits    bool
 	safeUnscale       bool
 	coolDownDelay     time.Duration
-	createdDate       time.Time
+	scaleToZero       bool
+	idleDelay         time.Duration
+	activationWorkers int32
+	idleSince         time.Time
+	dryRun            bool
+	paused            bool
+	pinReplicas       *int32
+	pinUntil          time.Time
+	failurePolicy     string
+	failureThreshold  int32
+	fallbackReplicas  int32
+	// failures consecutive ticks where the queues could not be read
+	failures    int32
+	createdDate time.Time
+	decision    string
+	// reason explains the last decision
+	reason          string
+	scaler          *RabbitScaler
+	consumers       int32
+	queueSize       int32
+	desiredReplicas int32
+	lastScaleTime   time.Time
+	// previous app replaced by this one, its state is inherited before the next scale
+	previous *App
+	// defaultLimits limits of the annotations, minWorkers, maxWorkers and offset are the ones of the open schedule window
+	defaultLimits scheduleLimits
+	schedule      []*scheduleWindow
+	// window name of the open schedule window, empty when the default limits are used
+	window   string
+	behavior *ScalingBehavior
+	// recommendations and scaleEvents history used by the behavior
+	recommendations []recommendation
+	scaleEvents     []scaleEvent
+}
+
+// Watch keeps the apps up to date with the workloads and RabbitScalers received from discovery
+func (a *Autoscaler) Watch(ctx context.Context) {
+	retry := time.NewTicker(scalerRetryPeriod)
+	defer retry.Stop()
+
+	for {
+		select {
+		case workload := <-a.add:
+			a.addWorkload(workload)
+		case workload := <-a.delete:
+			delete(a.scalerWorkloads, workload.key())
+			a.removeApp(workload.key())
+		case scaler := <-a.addScaler:
+			a.addRabbitScaler(scaler)
+		case scaler := <-a.deleteScaler:
+			a.removeRabbitScaler(scaler)
+		case <-retry.C:
+			a.retryRabbitScalers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// workloadHandler sends the workloads of the resource to the autoscaler
+func (a *Autoscaler) workloadHandler(resource schema.GroupVersionResource) handler {
+	return func(key string, object *unstructured.Unstructured) {
+		if object == nil {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+			a.delete <- &workload{resource: resource, namespace: namespace, name: name}
+			return
+		}
+		a.add <- newWorkload(resource, object)
+	}
+}
+
+func (a *Autoscaler) addWorkload(workload *workload) {
+	key := workload.key()
+	scaler, hasScaler := a.scalers[key]
+
+	// The workloads managed by a controller inherit its annotations (ex: the ReplicaSets of a Deployment),
+	// only the controller is scaled unless a RabbitScaler targets the workload
+	if len(workload.controller) > 0 && !hasScaler {
+		a.removeApp(key)
+		return
+	}
+
+	if hasScaler {
+		a.rememberScalerWorkload(key, workload)
+
+		// The RabbitScaler configuration takes precedence over the annotations
+		scaled := *workload
+		scaled.annotations = scaler.annotations()
+		workload = &scaled
+	}
+
+	app, err := createApp(workload, key)
+
+	if err == nil {
+		err = a.snapshots.sources.check(app)
+	}
+
+	if err != nil {
+		klog.Error(err)
+		if hasScaler || isEnabled(workload) {
+			a.reject(key, err)
+		} else {
+			a.mu.Lock()
+			delete(a.rejected, key)
+			a.mu.Unlock()
+		}
+		if hasScaler {
+			a.setValidity(scaler, corev1.ConditionFalse, InvalidSpecReason, err.Error())
+		} else if isEnabled(workload) {
+			a.recorder.Event(workload.object, corev1.EventTypeWarning, InvalidAnnotationsReason, err.Error())
+		}
+		return
+	}
+
+	if hasScaler {
+		app.scaler = scaler
+		a.setValidity(scaler, corev1.ConditionTrue, ValidSpecReason, "scaleTargetRef resolved to "+key)
+	}
+
+	a.mu.Lock()
+	if previous, ok := a.apps[key]; ok {
+		// Already exist
+		klog.Infof("Updating %s app", key)
+		// The previous app may be scaling, its state is inherited when the tick is over
+		app.previous = previous
+		if previous.previous != nil {
+			app.previous = previous.previous
+		}
+		forgetQueueMetrics(previous)
+	} else {
+		klog.Infof("New %s app", key)
+	}
+
+	a.apps[key] = app
+	delete(a.rejected, key)
+	a.mu.Unlock()
+}
+
+// rememberScalerWorkload keeps the workload targeted by a RabbitScaler, with its own annotations
+func (a *Autoscaler) rememberScalerWorkload(key string, target *workload) {
+	if a.scalerWorkloads == nil {
+		a.scalerWorkloads = make(map[string]*workload)
+	}
+	a.scalerWorkloads[key] = target
+}
+
+func (a *Autoscaler) removeApp(key string) {
+	a.mu.Lock()
+	app, ok := a.apps[key]
+	delete(a.apps, key)
+	delete(a.observations, key)
+	delete(a.rejected, key)
+	a.mu.Unlock()
+
+	if ok {
+		klog.Infof("Deleting app %s", key)
+		forgetMetrics(app)
+	}
 }
 
 // Run launch the autoscaler scale
-func (a *Autoscaler) Run(ctx context.Context, client *kubernetes.Clientset, loopTickSeconds int) {
+func (a *Autoscaler) Run(ctx context.Context, scaler scale.ScalesGetter, loopTickSeconds int) {
 
 	loopTick := time.NewTicker(time.Duration(loopTickSeconds) * time.Second)
 	defer func() {
 		loopTick.Stop()
 	}()
 
-	go func() {
-		for {
-			select {
-			case deployment := <-a.add:
-				key, _ := cache.MetaNamespaceKeyFunc(deployment)
-
-				app, err := createApp(deployment, key)
-
-				if err != nil {
-					klog.Error(err)
-					continue
-				}
-
-				if _, ok := a.apps[key]; ok {
-					// Already exist
-					klog.Infof("Updating %s app", key)
-				} else {
-					klog.Infof("New %s app", key)
-				}
-
-				a.apps[key] = app
-			case deployment := <-a.delete:
-				key, _ := cache.MetaNamespaceKeyFunc(deployment)
-				klog.Infof("Deleting app %s", key)
-				delete(a.apps, key)
-			case <-loopTick.C:
-				for _, app := range a.apps {
-
-					if app.isCoolDown() {
-						klog.Infof("%s is cooled down, waiting more (date %s, duration %s)", app.key, app.createdDate, app.coolDownDelay)
-						continue
-					}
-
-					consumers, queueSize, err := a.rmq.getQueueInformation(app.queue, app.vhost)
-
-					if err != nil {
-						klog.Infof("%s error during queue fetch, removing the app (%s)", app.key, err)
-						continue
-					}
-
-					// Get the next scale info
-					increment := app.scale(consumers, queueSize)
-
-					if app.safeUnscale && increment < 0 && queueSize > 0 {
-						klog.Infof("Safe unscale is enable in app %s, can't unscale when message are in queue", app.key)
-					} else if increment != 0 {
-						newReplica := app.replicas + increment
-						klog.Infof("%s Will be updated from %d replicas to %d", app.key, app.replicas, newReplica)
-						app.ref.Spec.Replicas = int32Ptr(newReplica)
-						newRef, err := client.AppsV1beta1().Deployments(app.ref.Namespace).Update(app.ref)
-
-						if err != nil {
-							klog.Errorf("Error during deployment (%s) update, retry later (%s)", app.key, err)
-						} else {
-							app.ref = newRef
-						}
-					}
-				}
+	// Only the leader writes the RabbitScalers status
+	go a.writeValidities(ctx)
+
+	for {
+		select {
+		case <-loopTick.C:
+			a.tick(ctx, scaler)
+		case <-ctx.Done():
+			// Block until the target provider is explicitly canceled.
+			return
+		}
+	}
+}
+
+// listApps returns the registered apps, the updated apps inherit the state of the app they replaced
+func (a *Autoscaler) listApps() []*App {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	apps := make([]*App, 0, len(a.apps))
+	for _, app := range a.apps {
+		if app.previous != nil {
+			app.inherit(app.previous)
+			app.previous = nil
+		}
+		apps = append(apps, app)
+	}
+
+	return apps
+}
+
+// tick scales all the apps from a single snapshot of the queues.
+// The apps are scaled concurrently by a bounded number of workers, each app has its own timeout
+func (a *Autoscaler) tick(ctx context.Context, scaler scale.ScalesGetter) {
+	apps := a.listApps()
+
+	// All the apps are scaled from a single listing of each vhost, each vhost has its own timeout
+	snapshot := a.snapshots.refresh(ctx, snapshotKeys(apps))
+
+	jobs := make(chan *App)
+	var wg sync.WaitGroup
+
+	for i := 0; i < a.workers || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for app := range jobs {
+				appCtx, cancel := context.WithTimeout(ctx, a.appTimeout)
+				a.autoscale(appCtx, app, scaler, snapshot)
+				cancel()
 			}
+		}()
+	}
+
+	for _, app := range apps {
+		jobs <- app
+	}
+	close(jobs)
+	wg.Wait()
+
+	// The apps deleted or updated during the tick may have set their metrics again
+	a.mu.Lock()
+	for _, app := range apps {
+		if current, ok := a.apps[app.key]; !ok {
+			forgetMetrics(app)
+		} else if current != app {
+			forgetQueueMetrics(app)
 		}
+	}
+	a.mu.Unlock()
+}
+
+// autoscale fetches the queue information of the app and updates its replicas if needed
+func (a *Autoscaler) autoscale(ctx context.Context, app *App, scaler scale.ScalesGetter, snapshot *queueSnapshot) {
+	var queueErr, scaleErr error
+
+	defer func() {
+		a.observe(app, queueErr)
 	}()
 
-	// Block until the target provider is explicitly canceled.
-	<-ctx.Done()
+	if app.scaler != nil {
+		defer func() {
+			a.updateScalerStatus(app.scaler, func(status *RabbitScalerStatus) {
+				app.writeStatus(status, queueErr, scaleErr)
+			})
+		}()
+	}
+
+	app.desiredReplicas = app.replicas
+	now := time.Now()
+	app.applySchedule(now)
+
+	// A workload scaled to zero must be woken up whatever the cool down, a paused or pinned workload isn't autoscaled
+	if app.isCoolDown() && !app.isScaledToZero() && !app.isManual(now) {
+		klog.Infof("%s is cooled down, waiting more (date %s, duration %s)", app.key, app.createdDate, app.coolDownDelay)
+		app.decide(decisionCoolDown, "created %s ago, waiting for the cool down delay (%s)", time.Since(app.createdDate).Round(time.Second), app.coolDownDelay)
+		observeDecision(app, app.desiredReplicas)
+		return
+	}
+
+	for _, queue := range app.queues {
+		queueErr = snapshot.fetch(queue)
+
+		if queueErr != nil {
+			// A configuration error (ex: a backend not configured) is not a failure of the broker
+			configErr := errorKind(queueErr) == ""
+			if !configErr {
+				app.failures++
+			}
+			observeQueueError(app, queueErr)
+			klog.Infof("%s error during queue fetch, skipping the app (%s)", app.key, queueErr)
+			a.recorder.Eventf(app.ref.object, corev1.EventTypeWarning, queueErrorReason(queueErr), "Unable to fetch queue %s on vhost %s: %s", queue.name, queue.vhost, queueErr)
+
+			// The pause and the pin don't need the queues
+			if app.isManual(now) {
+				break
+			}
+
+			if configErr {
+				app.decide(decisionFailure, "queue %s can't be read, keeping the replicas (%s)", queue.key(), queueErr)
+				observeDecision(app, app.desiredReplicas)
+				return
+			}
+
+			scaleErr = a.failed(ctx, app, scaler)
+			return
+		}
+	}
+
+	if queueErr == nil {
+		app.failures = 0
+		observeFailures(app)
+	}
+
+	consumers, queueSize := app.aggregateQueues()
+	app.consumers = consumers
+	app.queueSize = queueSize
+	observeQueue(app, consumers, queueSize)
+
+	// Get the next scale info
+	increment := app.scale(consumers, queueSize)
+
+	if app.safeUnscale && increment < 0 && queueSize > 0 && !app.isManual(now) {
+		klog.Infof("Safe unscale is enable in app %s, can't unscale when message are in queue", app.key)
+		app.decide(decisionSafeUnscaleBlocked, "can't scale down while %d messages are in queue (safe unscale)", queueSize)
+		observeDecision(app, app.desiredReplicas)
+		return
+	}
+
+	if increment == 0 {
+		observeDecision(app, app.desiredReplicas)
+		return
+	}
+
+	app.desiredReplicas = app.replicas + increment
+	observeDecision(app, app.desiredReplicas)
+	klog.Infof("%s Will be updated from %d replicas to %d", app.key, app.replicas, app.desiredReplicas)
+
+	if app.isManual(now) {
+		scaleErr = a.scaleTo(ctx, app, scaler, app.desiredReplicas, app.reason)
+		return
+	}
+
+	scaleErr = a.scaleTo(ctx, app, scaler, app.desiredReplicas, fmt.Sprintf("queue: %d / consumers: %d", queueSize, consumers))
+}
+
+// scaleTo updates the replicas of the app, in dry run the update is only logged and recorded in the events and metrics
+func (a *Autoscaler) scaleTo(ctx context.Context, app *App, scaler scale.ScalesGetter, replicas int32, details string) error {
+	increment := replicas - app.replicas
+
+	if a.dryRun || app.dryRun {
+		klog.Infof("%s is in dry run, not updated from %d replicas to %d (%s)", app.key, app.replicas, replicas, details)
+		a.recorder.Eventf(app.ref.object, corev1.EventTypeNormal, DryRunReason, "Would scale from %d to %d replicas (%s)", app.replicas, replicas, details)
+		observeDryRunScaleEvent(app, increment)
+		return nil
+	}
+
+	if err := app.ref.scale(ctx, scaler, replicas); err != nil {
+		klog.Errorf("Error during %s update, retry later (%s)", app.key, err)
+		a.recorder.Eventf(app.ref.object, corev1.EventTypeWarning, ScaleFailedReason, "Unable to scale from %d to %d replicas: %s", app.replicas, replicas, err)
+		return err
+	}
+
+	app.lastScaleTime = time.Now()
+	app.recordScaleEvent(app.lastScaleTime, increment)
+	a.recorder.Eventf(app.ref.object, corev1.EventTypeNormal, scaleReason(increment), "Scaled from %d to %d replicas (%s)", app.replicas, replicas, details)
+	observeScaleEvent(app, increment)
+	return nil
+}
+
+// decide sets the decision of the tick and its reason, shown by the admin API
+func (app *App) decide(decision string, format string, args ...interface{}) {
+	app.decision = decision
+	app.reason = fmt.Sprintf(format, args...)
+}
+
+// inherit keeps the state tracked across the ticks when an app is updated
+func (app *App) inherit(previous *App) {
+	app.idleSince = previous.idleSince
+	app.failures = previous.failures
+	app.window = previous.window
+	app.recommendations = previous.recommendations
+	app.scaleEvents = previous.scaleEvents
+}
+
+func (app *App) isScaledToZero() bool {
+	return app.scaleToZero && app.replicas == 0
 }
 
 func (app *App) isCoolDown() bool {
@@ -159,94 +556,292 @@ func (app *App) isCoolDown() bool {
 }
 
 func (app *App) scale(consumers int32, queueSize int32) int32 {
-	klog.Infof("%s, starting auto-scale decision", app.key)
+	klog.Infof("%s, starting auto-scale decision (min: %d / max: %d / offset: %d)", app.key, app.minWorkers, app.maxWorkers, app.offset)
+
+	if replicas, ok := app.manualDecision(time.Now()); ok {
+		return replicas - app.replicas
+	}
+
+	if app.scaleToZero {
+		if increment, decided := app.scaleToZeroDecision(queueSize); decided {
+			return increment
+		}
+	}
 
 	if app.readyWorkers != app.replicas {
 		klog.Infof("%s is currently unstable, retry later, not enough workers (ready: %d / wanted: %d)", app.key, app.readyWorkers, app.replicas)
+		app.decide(decisionUnstable, "not enough ready workers (ready: %d / replicas: %d)", app.readyWorkers, app.replicas)
 		return 0
 	}
 
 	if consumers != app.replicas {
 		klog.Infof("%s is currently unstable, consumer count not stable (ready: %d / real: %d)", app.key, app.readyWorkers, consumers)
+		app.decide(decisionUnstable, "consumer count not stable (consumers: %d / replicas: %d)", consumers, app.replicas)
 		return 0
 	}
 
 	if consumers > app.maxWorkers {
 		klog.Infof("%s have to much worker (%d), need to decrease to max (%d)", app.key, consumers, app.maxWorkers)
 		if !app.overrideLimits {
+			app.decide(decisionDown, "above the max workers (consumers: %d / max: %d)", consumers, app.maxWorkers)
 			return app.maxWorkers - app.replicas
 		}
 		klog.Infof("%s limits are override, do nothing", app.key)
+		app.decide(decisionNone, "above the max workers (consumers: %d / max: %d), limits are overridden", consumers, app.maxWorkers)
 		return 0
 	}
 
 	if consumers < app.minWorkers {
 		klog.Infof("%s have not enough worker (%d), need to increase to min (%d)", app.key, consumers, app.minWorkers)
 		if !app.overrideLimits {
+			app.decide(decisionUp, "below the min workers (consumers: %d / min: %d)", consumers, app.minWorkers)
 			return app.minWorkers - app.replicas
 		}
 		klog.Infof("%s limits are override, do nothing", app.key)
+		app.decide(decisionNone, "below the min workers (consumers: %d / min: %d), limits are overridden", consumers, app.minWorkers)
 		return 0
 	}
 
-	scale := int32(math.Ceil(float64(queueSize)/float64(app.messagesPerWorker))) - consumers + app.offset
+	scale := app.neededWorkers(consumers, queueSize) - consumers + app.offset
+	now := time.Now()
+
+	if app.behavior != nil {
+		stabilized, ok := app.stabilize(consumers, scale, now)
+		if !ok {
+			return 0
+		}
+		scale = stabilized
+	}
 
 	if scale > 0 {
 		if consumers == app.maxWorkers {
 			klog.Infof("%s has already the maximum workers (%d), can do anything more (queueSize: %d / consumers: %d)", app.key, app.maxWorkers, queueSize, consumers)
+			app.decide(decisionNone, "at the max workers (%d), %d more workers needed (queue: %d)", app.maxWorkers, scale, queueSize)
 			return 0
 		}
-		scaleUp := min(scale, app.steps)
-		klog.Infof("%s will scale with %d (steps: %d / readyMessages: %d)", app.key, scaleUp, app.steps, scale)
+		limit, limitedBy := app.scaleUpLimit(now)
+		scaleUp := min(scale, limit)
+		if scaleUp <= 0 {
+			klog.Infof("%s can't scale up for now, %d more workers needed (%s)", app.key, scale, limitedBy)
+			app.decide(decisionNone, "%d more workers needed, scale up limited by the behavior (%s)", scale, limitedBy)
+			return 0
+		}
+		klog.Infof("%s will scale with %d (%s / readyMessages: %d)", app.key, scaleUp, limitedBy, scale)
+		app.decide(decisionUp, "%d more workers needed, scaling up by %d (queue: %d / consumers: %d / %s)", scale, scaleUp, queueSize, consumers, limitedBy)
 		return scaleUp
 	} else if scale < 0 {
 		if consumers == app.minWorkers {
 			klog.Infof("%s has already the minimum workers (%d), can do anything more (queueSize: %d / consumers: %d)", app.key, app.minWorkers, queueSize, consumers)
+			app.decide(decisionNone, "at the min workers (%d), %d less workers needed (queue: %d)", app.minWorkers, -scale, queueSize)
 			return 0
 		}
-		scaleDown := max(scale, -app.steps)
-		klog.Infof("%s will scale with %d (steps: %d / readyMessages: %d)", app.key, scaleDown, app.steps, scale)
+		limit, limitedBy := app.scaleDownLimit(now)
+		scaleDown := max(scale, -limit)
+		if scaleDown >= 0 {
+			klog.Infof("%s can't scale down for now, %d less workers needed (%s)", app.key, -scale, limitedBy)
+			app.decide(decisionNone, "%d less workers needed, scale down limited by the behavior (%s)", -scale, limitedBy)
+			return 0
+		}
+		klog.Infof("%s will scale with %d (%s / readyMessages: %d)", app.key, scaleDown, limitedBy, scale)
+		app.decide(decisionDown, "%d less workers needed, scaling down by %d (queue: %d / consumers: %d / %s)", -scale, -scaleDown, queueSize, consumers, limitedBy)
 		return scaleDown
 	}
 
 	// Nothing to do
 	klog.Infof("%s nothing to do with current queue size (queue: %d / consumers: %d / offset: %d)", app.key, queueSize, consumers, app.offset)
+	app.decide(decisionNone, "workers match the queue (queue: %d / consumers: %d / offset: %d)", queueSize, consumers, app.offset)
 	return 0
 }
 
-func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
-	if _, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Enable]; !ok {
-		return nil, errors.New(key + " not concerned by autoscaling, skipping")
+// aggregateQueues returns the consumers and messages of all the queues.
+// The workers consume every queue, the lowest consumer count is used for the stability check.
+// The consumers of a pattern depend on how the workers share the matching queues, they are not compared
+// with the replicas: with only patterns the ready workers are used
+func (app *App) aggregateQueues() (int32, int32) {
+	var messages int32
+	consumers := int32(-1)
+
+	for _, queue := range app.queues {
+		if queue.pattern == nil && (consumers < 0 || queue.consumers < consumers) {
+			consumers = queue.consumers
+		}
+		messages += queue.messages
+	}
+
+	if consumers < 0 {
+		consumers = app.readyWorkers
+	}
+
+	return consumers, messages
+}
+
+// neededWorkers returns the workers needed by the queues, combined with the aggregation of the app
+func (app *App) neededWorkers(consumers int32, queueSize int32) int32 {
+	if len(app.queues) == 0 {
+		// Only the totals are known
+		return app.queueWorkers(&appQueue{messagesPerWorker: app.messagesPerWorker, messages: queueSize, consumers: consumers})
 	}
 
-	var app *App
+	var needed int32
 
-	if queue, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Queue]; ok {
-		app = &App{
-			ref:               deployment,
-			key:               key,
-			queue:             queue,
-			replicas:          *deployment.Spec.Replicas,
-			readyWorkers:      deployment.Status.ReadyReplicas,
-			overrideLimits:    false,
-			safeUnscale:       true,
-			offset:            0,
-			steps:             1,
-			messagesPerWorker: 1,
-			coolDownDelay:     0,
-			createdDate:       time.Now(),
+	for _, queue := range app.queues {
+		queue.workers = app.queueWorkers(queue)
+
+		if len(app.queues) > 1 {
+			klog.Infof("%s queue %s needs %d workers (messages: %d / consumers: %d)", app.key, queue.key(), queue.workers, queue.messages, queue.consumers)
 		}
-	} else {
+
+		if app.aggregation == AggregationMax {
+			needed = max(needed, queue.workers)
+		} else {
+			needed += queue.workers
+		}
+	}
+
+	return needed
+}
+
+// queueWorkers returns the workers needed to drain the backlog of a queue.
+// With a rate per worker, enough workers are also kept to absorb the publish rate,
+// the backlog only is used when RabbitMQ has no stats for the queue
+func (app *App) queueWorkers(queue *appQueue) int32 {
+	backlog := int32(math.Ceil(float64(queue.messages) / float64(queue.messagesPerWorker)))
+
+	if app.targetDrainTime > 0 {
+		if drain, ok := app.drainWorkers(queue); ok {
+			backlog = drain
+		} else {
+			klog.Infof("%s has no ack rate, falling back to messages per worker", app.key)
+		}
+	}
+
+	if app.ratePerWorker <= 0 {
+		return backlog
+	}
+
+	publishRate, ok := queue.stats.publishRate()
+	if !ok {
+		klog.Infof("%s has no message stats, falling back to the queue size", app.key)
+		return backlog
+	}
+
+	rate := int32(math.Ceil(publishRate / app.ratePerWorker))
+	klog.Infof("%s needs %d workers for the backlog and %d for the publish rate (%.2f/s)", app.key, backlog, rate, publishRate)
+
+	return max(backlog, rate)
+}
+
+// drainWorkers returns the workers needed to empty the queue within the target drain time,
+// from the throughput of the current consumers. Returns false when the throughput is unknown.
+// The consumers of a pattern are summed over the matching queues, the throughput is shared by the ready workers
+func (app *App) drainWorkers(queue *appQueue) (int32, bool) {
+	rate := queue.stats.workersRate()
+
+	consumers := queue.consumers
+	if queue.pattern != nil {
+		consumers = app.readyWorkers
+	}
+
+	if consumers <= 0 || rate <= 0 {
+		return 0, false
+	}
+
+	perWorker := rate / float64(consumers)
+	workers := int32(math.Ceil(float64(queue.messages) / (perWorker * app.targetDrainTime.Seconds())))
+	klog.Infof("%s needs %d workers to drain %d messages in %s (%.2f/s per worker)", app.key, workers, queue.messages, app.targetDrainTime, perWorker)
+
+	// The oldest message already waited longer than the target, the current workers are late
+	if !queue.oldestMessage.IsZero() && queue.messages > 0 {
+		if age := time.Since(queue.oldestMessage); age > app.targetDrainTime {
+			klog.Infof("%s oldest message is %s old, more than the target drain time", app.key, age)
+			workers = max(workers, consumers+1)
+		}
+	}
+
+	return workers, true
+}
+
+func isEnabled(workload *workload) bool {
+	_, ok := workload.annotations[AnnotationPrefix+Enable]
+	return ok
+}
+
+// scaleToZeroDecision wakes up or scales to zero the app, returns false when the usual decision has to be taken.
+// The stability checks are skipped as there is no consumer to wait for
+func (app *App) scaleToZeroDecision(queueSize int32) (int32, bool) {
+	if app.replicas == 0 {
+		if queueSize > 0 {
+			klog.Infof("%s has %d messages and no workers, waking up with %d workers", app.key, queueSize, app.activationWorkers)
+			app.idleSince = time.Time{}
+			app.decide(decisionUp, "scaled to zero with %d messages in queue, waking up with %d workers", queueSize, app.activationWorkers)
+			return app.activationWorkers, true
+		}
+
+		klog.Infof("%s is scaled to zero, waiting for messages", app.key)
+		app.decide(decisionNone, "scaled to zero, waiting for messages")
+		return 0, true
+	}
+
+	if queueSize > 0 {
+		app.idleSince = time.Time{}
+		return 0, false
+	}
+
+	if app.idleSince.IsZero() {
+		app.idleSince = time.Now()
+	}
+
+	if time.Now().Sub(app.idleSince) < app.idleDelay {
+		return 0, false
+	}
+
+	klog.Infof("%s queue is empty since %s, scaling to zero", app.key, app.idleSince)
+	app.decide(decisionDown, "queue empty since %s, scaling to zero", app.idleSince.Format(time.RFC3339))
+	return -app.replicas, true
+}
+
+func createApp(workload *workload, key string) (*App, error) {
+	if !isEnabled(workload) {
+		return nil, errors.New(key + " not concerned by autoscaling, skipping")
+	}
+
+	app := &App{
+		ref:               workload,
+		key:               key,
+		replicas:          workload.replicas,
+		readyWorkers:      workload.readyReplicas,
+		backend:           DefaultBackend,
+		cluster:           DefaultCluster,
+		aggregation:       AggregationSum,
+		overrideLimits:    false,
+		safeUnscale:       true,
+		offset:            0,
+		steps:             1,
+		messagesPerWorker: 1,
+		coolDownDelay:     0,
+		idleDelay:         5 * time.Minute,
+		failurePolicy:     FailurePolicyHold,
+		failureThreshold:  3,
+		createdDate:       time.Now(),
+	}
+
+	// The queue is optional with a pattern, the queue and vhost are optional when other queues are listed
+	queues, hasQueues := workload.annotations[AnnotationPrefix+Queues]
+	pattern, hasPattern := workload.annotations[AnnotationPrefix+QueuePattern]
+
+	if queue, ok := workload.annotations[AnnotationPrefix+Queue]; ok {
+		app.queue = queue
+	} else if !hasQueues && !hasPattern {
 		return nil, fmt.Errorf(missingPropertyError, key, Queue)
 	}
 
-	if vhost, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Vhost]; ok {
+	if vhost, ok := workload.annotations[AnnotationPrefix+Vhost]; ok {
 		app.vhost = vhost
-	} else {
+	} else if !hasQueues || len(app.queue) > 0 || hasPattern {
 		return nil, fmt.Errorf(missingPropertyError, key, Vhost)
 	}
 
-	if minWorkers, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+MinWorkers]; ok {
+	if minWorkers, ok := workload.annotations[AnnotationPrefix+MinWorkers]; ok {
 		minWorkers, err := strconv.ParseInt(minWorkers, 10, 32)
 
 		if err != nil {
@@ -258,7 +853,7 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		return nil, fmt.Errorf(missingPropertyError, key, MinWorkers)
 	}
 
-	if maxWorkers, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+MaxWorkers]; ok {
+	if maxWorkers, ok := workload.annotations[AnnotationPrefix+MaxWorkers]; ok {
 		maxWorkers, err := strconv.ParseInt(maxWorkers, 10, 32)
 
 		if err != nil {
@@ -270,7 +865,21 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		return nil, fmt.Errorf(missingPropertyError, key, MaxWorkers)
 	}
 
-	if steps, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Steps]; ok {
+	if ratePerWorker, ok := workload.annotations[AnnotationPrefix+RatePerWorker]; ok {
+		ratePerWorker, err := strconv.ParseFloat(ratePerWorker, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAFloat, key, RatePerWorker)
+		}
+
+		if !(ratePerWorker > 0) {
+			return nil, fmt.Errorf(notPositiveError, key, RatePerWorker)
+		}
+
+		app.ratePerWorker = ratePerWorker
+	}
+
+	if steps, ok := workload.annotations[AnnotationPrefix+Steps]; ok {
 		steps, err := strconv.ParseInt(steps, 10, 32)
 
 		if err != nil {
@@ -280,7 +889,7 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		app.steps = int32(steps)
 	}
 
-	if messagesPerWorker, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+MessagesPerWorker]; ok {
+	if messagesPerWorker, ok := workload.annotations[AnnotationPrefix+MessagesPerWorker]; ok {
 		messagesPerWorker, err := strconv.ParseInt(messagesPerWorker, 10, 32)
 
 		if err != nil {
@@ -290,7 +899,76 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		app.messagesPerWorker = int32(messagesPerWorker)
 	}
 
-	if offset, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Offset]; ok {
+	if backend, ok := workload.annotations[AnnotationPrefix+Backend]; ok {
+		if len(backend) == 0 {
+			return nil, fmt.Errorf(missingPropertyError, key, Backend)
+		}
+
+		app.backend = backend
+	}
+
+	if cluster, ok := workload.annotations[AnnotationPrefix+Cluster]; ok {
+		if len(cluster) == 0 {
+			return nil, fmt.Errorf(missingPropertyError, key, Cluster)
+		}
+
+		app.cluster = cluster
+	}
+
+	if secret, ok := workload.annotations[AnnotationPrefix+CredentialsSecret]; ok {
+		if len(secret) == 0 {
+			return nil, fmt.Errorf(missingPropertyError, key, CredentialsSecret)
+		}
+
+		app.credentials = workload.namespace + "/" + secret
+	}
+
+	if len(app.queue) > 0 {
+		app.queues = append(app.queues, &appQueue{vhost: app.vhost, name: app.queue, messagesPerWorker: app.messagesPerWorker})
+	}
+
+	if hasPattern {
+		parsed, err := parseQueuePattern(key, pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		app.queues = append(app.queues, &appQueue{vhost: app.vhost, name: pattern, pattern: parsed, messagesPerWorker: app.messagesPerWorker})
+	}
+
+	if hasQueues {
+		others, err := parseQueues(key, queues, app.messagesPerWorker)
+
+		if err != nil {
+			return nil, err
+		}
+
+		app.queues = append(app.queues, others...)
+	}
+
+	if len(app.queues) == 0 {
+		return nil, fmt.Errorf(missingPropertyError, key, Queue)
+	}
+
+	for _, queue := range app.queues {
+		queue.backend = app.backend
+		queue.cluster = app.cluster
+		queue.credentials = app.credentials
+	}
+
+	// The first queue is used in the logs and events
+	app.queue, app.vhost = app.queues[0].name, app.queues[0].vhost
+
+	if aggregation, ok := workload.annotations[AnnotationPrefix+QueuesAggregation]; ok {
+		if aggregation != AggregationSum && aggregation != AggregationMax {
+			return nil, fmt.Errorf(notInListError, key, QueuesAggregation, []string{AggregationSum, AggregationMax})
+		}
+
+		app.aggregation = aggregation
+	}
+
+	if offset, ok := workload.annotations[AnnotationPrefix+Offset]; ok {
 		offset, err := strconv.ParseInt(offset, 10, 32)
 
 		if err != nil {
@@ -300,17 +978,17 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		app.offset = int32(offset)
 	}
 
-	if overrideLimit, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+Override]; ok {
+	if overrideLimit, ok := workload.annotations[AnnotationPrefix+Override]; ok {
 		overrideLimit, err := strconv.ParseBool(overrideLimit)
 
 		if err != nil {
-			return nil, fmt.Errorf(notAnIntError, key, Offset)
+			return nil, fmt.Errorf(notAnBool, key, Override)
 		}
 
 		app.overrideLimits = overrideLimit
 	}
 
-	if safeUnscale, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+SafeUnscale]; ok {
+	if safeUnscale, ok := workload.annotations[AnnotationPrefix+SafeUnscale]; ok {
 		safeUnscale, err := strconv.ParseBool(safeUnscale)
 
 		if err != nil {
@@ -320,7 +998,7 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		app.safeUnscale = safeUnscale
 	}
 
-	if coolDownDelay, ok := deployment.ObjectMeta.Annotations[AnnotationPrefix+CoolDownDelay]; ok {
+	if coolDownDelay, ok := workload.annotations[AnnotationPrefix+CoolDownDelay]; ok {
 		coolDownDelay, err := time.ParseDuration(coolDownDelay)
 
 		if err != nil {
@@ -330,9 +1008,214 @@ func createApp(deployment *v1beta1.Deployment, key string) (*App, error) {
 		app.coolDownDelay = coolDownDelay
 	}
 
+	if targetDrainTime, ok := workload.annotations[AnnotationPrefix+TargetDrainTime]; ok {
+		targetDrainTime, err := time.ParseDuration(targetDrainTime)
+
+		if err != nil {
+			return nil, fmt.Errorf(notADuration, key, TargetDrainTime)
+		}
+
+		if targetDrainTime <= 0 {
+			return nil, fmt.Errorf(notPositiveError, key, TargetDrainTime)
+		}
+
+		app.targetDrainTime = targetDrainTime
+	}
+
+	if scaleToZero, ok := workload.annotations[AnnotationPrefix+ScaleToZero]; ok {
+		scaleToZero, err := strconv.ParseBool(scaleToZero)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnBool, key, ScaleToZero)
+		}
+
+		app.scaleToZero = scaleToZero
+	}
+
+	if idleDelay, ok := workload.annotations[AnnotationPrefix+IdleDelay]; ok {
+		idleDelay, err := time.ParseDuration(idleDelay)
+
+		if err != nil {
+			return nil, fmt.Errorf(notADuration, key, IdleDelay)
+		}
+
+		app.idleDelay = idleDelay
+	}
+
+	app.activationWorkers = max(app.minWorkers, 1)
+
+	if activationWorkers, ok := workload.annotations[AnnotationPrefix+ActivationWorkers]; ok {
+		activationWorkers, err := strconv.ParseInt(activationWorkers, 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnIntError, key, ActivationWorkers)
+		}
+
+		app.activationWorkers = int32(activationWorkers)
+	}
+
+	if paused, ok := workload.annotations[AnnotationPrefix+Paused]; ok {
+		paused, err := strconv.ParseBool(paused)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnBool, key, Paused)
+		}
+
+		app.paused = paused
+	}
+
+	pinReplicas, hasPinReplicas := workload.annotations[AnnotationPrefix+PinReplicas]
+	pinUntil, hasPinUntil := workload.annotations[AnnotationPrefix+PinUntil]
+
+	if hasPinReplicas != hasPinUntil {
+		if hasPinReplicas {
+			return nil, fmt.Errorf(missingPropertyError, key, PinUntil)
+		}
+		return nil, fmt.Errorf(missingPropertyError, key, PinReplicas)
+	}
+
+	if hasPinReplicas {
+		replicas, err := strconv.ParseInt(pinReplicas, 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnIntError, key, PinReplicas)
+		}
+
+		until, err := time.Parse(time.RFC3339, pinUntil)
+
+		if err != nil {
+			return nil, fmt.Errorf(notATime, key, PinUntil)
+		}
+
+		app.pinReplicas = int32Ptr(int32(replicas))
+		app.pinUntil = until
+	}
+
+	if dryRun, ok := workload.annotations[AnnotationPrefix+DryRun]; ok {
+		dryRun, err := strconv.ParseBool(dryRun)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnBool, key, DryRun)
+		}
+
+		app.dryRun = dryRun
+	}
+
+	if failurePolicy, ok := workload.annotations[AnnotationPrefix+FailurePolicy]; ok {
+		if failurePolicy != FailurePolicyHold && failurePolicy != FailurePolicyFallback && failurePolicy != FailurePolicyMin {
+			return nil, fmt.Errorf(notInListError, key, FailurePolicy, []string{FailurePolicyHold, FailurePolicyFallback, FailurePolicyMin})
+		}
+
+		app.failurePolicy = failurePolicy
+	}
+
+	if failureThreshold, ok := workload.annotations[AnnotationPrefix+FailureThreshold]; ok {
+		failureThreshold, err := strconv.ParseInt(failureThreshold, 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnIntError, key, FailureThreshold)
+		}
+
+		app.failureThreshold = int32(failureThreshold)
+	}
+
+	if fallbackReplicas, ok := workload.annotations[AnnotationPrefix+FallbackReplicas]; ok {
+		fallbackReplicas, err := strconv.ParseInt(fallbackReplicas, 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf(notAnIntError, key, FallbackReplicas)
+		}
+
+		app.fallbackReplicas = int32(fallbackReplicas)
+	} else if app.failurePolicy == FailurePolicyFallback {
+		return nil, fmt.Errorf(missingPropertyError, key, FallbackReplicas)
+	}
+
+	if err := validateApp(app); err != nil {
+		return nil, err
+	}
+
+	if behavior, ok := workload.annotations[AnnotationPrefix+Behavior]; ok {
+		parsed, err := parseBehavior(key, behavior)
+
+		if err != nil {
+			return nil, err
+		}
+
+		app.behavior = parsed
+	}
+
+	app.defaultLimits = scheduleLimits{minWorkers: app.minWorkers, maxWorkers: app.maxWorkers, offset: app.offset}
+
+	if schedule, ok := workload.annotations[AnnotationPrefix+Schedule]; ok {
+		windows, err := parseSchedule(key, schedule, app.defaultLimits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		app.schedule = windows
+	}
+
 	return app, nil
 }
 
+// validateApp checks the semantic of the parsed values
+func validateApp(app *App) error {
+	if app.minWorkers < 0 {
+		return fmt.Errorf(negativeError, app.key, MinWorkers)
+	}
+
+	if app.minWorkers > app.maxWorkers {
+		return fmt.Errorf(minGreaterThanMax, app.key, MinWorkers, MaxWorkers)
+	}
+
+	if app.steps < 1 {
+		return fmt.Errorf(notPositiveError, app.key, Steps)
+	}
+
+	if app.messagesPerWorker < 1 {
+		return fmt.Errorf(notPositiveError, app.key, MessagesPerWorker)
+	}
+
+	if app.coolDownDelay < 0 {
+		return fmt.Errorf(negativeError, app.key, CoolDownDelay)
+	}
+
+	if app.idleDelay < 0 {
+		return fmt.Errorf(negativeError, app.key, IdleDelay)
+	}
+
+	// Without scale to zero the activation workers are never used, a parked workload (max-workers=0) stays valid
+	if app.scaleToZero {
+		if app.activationWorkers < 1 {
+			return fmt.Errorf(notPositiveError, app.key, ActivationWorkers)
+		}
+
+		if app.activationWorkers > app.maxWorkers {
+			return fmt.Errorf(minGreaterThanMax, app.key, ActivationWorkers, MaxWorkers)
+		}
+	}
+
+	if app.pinReplicas != nil && *app.pinReplicas < 0 {
+		return fmt.Errorf(negativeError, app.key, PinReplicas)
+	}
+
+	if app.failureThreshold < 1 {
+		return fmt.Errorf(notPositiveError, app.key, FailureThreshold)
+	}
+
+	if app.fallbackReplicas < 0 {
+		return fmt.Errorf(negativeError, app.key, FallbackReplicas)
+	}
+
+	if app.fallbackReplicas > app.maxWorkers {
+		return fmt.Errorf(minGreaterThanMax, app.key, FallbackReplicas, MaxWorkers)
+	}
+
+	return nil
+}
+
 func int32Ptr(i int32) *int32 { return &i }
 
 func min(a, b int32) int32 {
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
-	"k8s.io/api/apps/v1beta1"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/scale"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -22,6 +35,99 @@ var (
 	}
 )
 
+func float64Ptr(f float64) *float64 { return &f }
+
+// fakeScales stores the replicas of a single workload, the first updates fail with a conflict
+type fakeScales struct {
+	replicas  int32
+	conflicts int
+	updates   int
+}
+
+func (f *fakeScales) Scales(namespace string) scale.ScaleInterface {
+	return f
+}
+
+func (f *fakeScales) Get(resource schema.GroupResource, name string) (*autoscalingv1.Scale, error) {
+	return &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: f.replicas}}, nil
+}
+
+func (f *fakeScales) Update(resource schema.GroupResource, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error) {
+	f.updates++
+	if f.updates <= f.conflicts {
+		return nil, errors.NewConflict(resource, "worker", nil)
+	}
+	f.replicas = scale.Spec.Replicas
+	return scale, nil
+}
+
+// fakeObjects stores the objects by name, an update with an outdated resourceVersion is a conflict
+type fakeObjects struct {
+	dynamic.Interface
+	dynamic.NamespaceableResourceInterface
+	mu       sync.Mutex
+	resource schema.GroupVersionResource
+	objects  map[string]*unstructured.Unstructured
+}
+
+func (f *fakeObjects) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.resource = resource
+	return f
+}
+
+func (f *fakeObjects) Namespace(namespace string) dynamic.ResourceInterface {
+	return f
+}
+
+func (f *fakeObjects) Get(name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, ok := f.objects[name]
+	if !ok {
+		return nil, errors.NewNotFound(f.resource.GroupResource(), name)
+	}
+	return object.DeepCopy(), nil
+}
+
+func (f *fakeObjects) Create(object *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.objects[object.GetName()]; ok {
+		return nil, errors.NewAlreadyExists(f.resource.GroupResource(), object.GetName())
+	}
+	object = object.DeepCopy()
+	object.SetResourceVersion("1")
+	f.objects[object.GetName()] = object
+	return object.DeepCopy(), nil
+}
+
+func (f *fakeObjects) Update(object *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, ok := f.objects[object.GetName()]
+	if !ok {
+		return nil, errors.NewNotFound(f.resource.GroupResource(), object.GetName())
+	}
+	if current.GetResourceVersion() != object.GetResourceVersion() {
+		return nil, errors.NewConflict(f.resource.GroupResource(), object.GetName(), nil)
+	}
+	version, _ := strconv.Atoi(current.GetResourceVersion())
+	object = object.DeepCopy()
+	object.SetResourceVersion(strconv.Itoa(version + 1))
+	f.objects[object.GetName()] = object
+	return object.DeepCopy(), nil
+}
+
+func (f *fakeObjects) UpdateStatus(object *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	return f.Update(object, options, "status")
+}
+
 func TestUnstable(t *testing.T) {
 	incReplicas := app.scale(0, 1)
 
@@ -35,6 +141,10 @@ func TestUnstable(t *testing.T) {
 	if incReplicas != 0 {
 		t.Error("Expected 0, got ", incReplicas)
 	}
+
+	if app.decision != decisionUnstable {
+		t.Error("Expected unstable decision, got ", app.decision)
+	}
 }
 
 func TestScaleUp(t *testing.T) {
@@ -48,6 +158,10 @@ func TestScaleUp(t *testing.T) {
 		t.Error("Expected 1, got ", incReplicas)
 	}
 
+	if app.decision != decisionUp {
+		t.Error("Expected up decision, got ", app.decision)
+	}
+
 	app.readyWorkers = 2
 	app.replicas = 2
 	incReplicas = app.scale(2, 4)
@@ -205,6 +319,276 @@ func TestMessagePerWorker(t *testing.T) {
 	}
 }
 
+func TestRatePerWorker(t *testing.T) {
+	queue := &appQueue{vhost: "vhost", name: "queue", messagesPerWorker: 1, consumers: 2}
+	app := &App{
+		key:               "rate",
+		queues:            []*appQueue{queue},
+		minWorkers:        1,
+		maxWorkers:        10,
+		messagesPerWorker: 1,
+		ratePerWorker:     2,
+		readyWorkers:      2,
+		replicas:          2,
+		steps:             10,
+		createdDate:       time.Now(),
+	}
+
+	queue.messages = 1
+	incReplicas := app.scale(2, 1)
+
+	// No stats, fallback on the queue size
+	if incReplicas != -1 {
+		t.Error("Expected -1, got ", incReplicas)
+	}
+
+	queue.messages = 0
+	queue.stats = &QueueRates{Publish: float64Ptr(9)}
+	incReplicas = app.scale(2, 0)
+
+	// 9 messages/s need 5 workers handling 2 messages/s
+	if incReplicas != 3 {
+		t.Error("Expected 3, got ", incReplicas)
+	}
+
+	queue.messages = 8
+	incReplicas = app.scale(2, 8)
+
+	// The backlog needs more workers than the rate
+	if incReplicas != 6 {
+		t.Error("Expected 6, got ", incReplicas)
+	}
+}
+
+func TestTargetDrainTime(t *testing.T) {
+	queue := &appQueue{vhost: "vhost", name: "queue", messagesPerWorker: 1, consumers: 2}
+	app := &App{
+		key:               "drain",
+		queues:            []*appQueue{queue},
+		minWorkers:        1,
+		maxWorkers:        20,
+		messagesPerWorker: 1,
+		targetDrainTime:   time.Minute,
+		readyWorkers:      2,
+		replicas:          2,
+		steps:             20,
+		createdDate:       time.Now(),
+	}
+
+	queue.messages = 4
+	incReplicas := app.scale(2, 4)
+
+	// No ack rate, fallback on messages per worker
+	if incReplicas != 2 {
+		t.Error("Expected 2, got ", incReplicas)
+	}
+
+	// Each worker acks 0.1 message/s, 6 messages per minute
+	queue.stats = &QueueRates{Ack: float64Ptr(0.2)}
+	queue.messages = 30
+	incReplicas = app.scale(2, 30)
+
+	// 30 messages need 5 workers to be drained in a minute
+	if incReplicas != 3 {
+		t.Error("Expected 3, got ", incReplicas)
+	}
+
+	queue.messages = 12
+	incReplicas = app.scale(2, 12)
+
+	// Already draining fast enough
+	if incReplicas != 0 {
+		t.Error("Expected 0, got ", incReplicas)
+	}
+
+	queue.oldestMessage = time.Now().Add(-2 * time.Minute)
+	incReplicas = app.scale(2, 12)
+
+	// Oldest message is late, add a worker
+	if incReplicas != 1 {
+		t.Error("Expected 1, got ", incReplicas)
+	}
+}
+
+func TestTargetDrainTimePattern(t *testing.T) {
+	// Each of the 2 workers consumes the 3 matching queues, the consumers and the ack rate are summed
+	pattern, _ := parseQueuePattern("test", "orders.shard-*")
+	queue := &appQueue{vhost: "vhost", name: "orders.shard-*", pattern: pattern, messagesPerWorker: 1, consumers: 6}
+	app := &App{
+		key:               "drain-pattern",
+		queues:            []*appQueue{queue},
+		minWorkers:        1,
+		maxWorkers:        20,
+		messagesPerWorker: 1,
+		targetDrainTime:   time.Minute,
+		readyWorkers:      2,
+		replicas:          2,
+		steps:             20,
+		createdDate:       time.Now(),
+	}
+
+	// Each worker acks 0.1 message/s over all the matching queues
+	queue.stats = &QueueRates{Ack: float64Ptr(0.2)}
+	queue.messages = 30
+	incReplicas := app.scale(2, 30)
+
+	// 30 messages need 5 workers to be drained in a minute
+	if incReplicas != 3 {
+		t.Error("Expected 3, got ", incReplicas)
+	}
+}
+
+func TestMultipleQueues(t *testing.T) {
+	app := &App{
+		key: "queues",
+		queues: []*appQueue{
+			{vhost: "vhost", name: "primary", messagesPerWorker: 1, messages: 3, consumers: 2},
+			{vhost: "vhost", name: "retry", messagesPerWorker: 10, messages: 25, consumers: 2},
+			{vhost: "other", name: "priority", messagesPerWorker: 1, messages: 1, consumers: 1},
+		},
+		aggregation:       AggregationSum,
+		minWorkers:        1,
+		maxWorkers:        20,
+		messagesPerWorker: 1,
+		readyWorkers:      2,
+		replicas:          2,
+		steps:             20,
+		createdDate:       time.Now(),
+	}
+
+	consumers, queueSize := app.aggregateQueues()
+
+	if consumers != 1 || queueSize != 29 {
+		t.Error("Expected 1 consumer and 29 messages, got ", consumers, queueSize)
+	}
+
+	// Each worker consumes one shard of the pattern, the consumers of the pattern are not compared
+	pattern, _ := parseQueuePattern("test", "orders.shard-*")
+	app.queues = append(app.queues, &appQueue{vhost: "vhost", name: "orders.shard-*", pattern: pattern, messagesPerWorker: 100, consumers: 1})
+
+	if consumers, _ := app.aggregateQueues(); consumers != 1 {
+		t.Error("Expected 1 consumer, got ", consumers)
+	}
+
+	shards := &App{key: "shards", queues: app.queues[3:], readyWorkers: 2, replicas: 2}
+
+	if consumers, queueSize := shards.aggregateQueues(); consumers != 2 || queueSize != 0 {
+		t.Error("Expected the 2 ready workers and 0 messages, got ", consumers, queueSize)
+	}
+
+	app.queues = app.queues[:3]
+	app.queues[2].consumers = 2
+
+	// 3 + 3 + 1 workers needed
+	incReplicas := app.scale(2, 29)
+
+	if incReplicas != 5 {
+		t.Error("Expected 5, got ", incReplicas)
+	}
+
+	if app.queues[1].workers != 3 {
+		t.Error("Expected 3 workers for the retry queue, got ", app.queues[1].workers)
+	}
+
+	app.aggregation = AggregationMax
+	incReplicas = app.scale(2, 29)
+
+	if incReplicas != 1 {
+		t.Error("Expected 1, got ", incReplicas)
+	}
+}
+
+func TestQueuePattern(t *testing.T) {
+	glob, err := parseQueuePattern("test", "orders.shard-*")
+
+	if err != nil {
+		t.Error("Glob should be valid", err)
+	}
+
+	regex, err := parseQueuePattern("test", "/^orders\\.shard-[0-9]+$/")
+
+	if err != nil {
+		t.Error("Regex should be valid", err)
+	}
+
+	timestamp := int64(1000)
+	queues := []*QueueStats{
+		{Name: "orders.shard-0", Messages: 3, Consumers: 1, Rates: &QueueRates{Publish: float64Ptr(1)}},
+		{Name: "orders.shard-1", Messages: 5, Consumers: 1, Rates: &QueueRates{Publish: float64Ptr(2)}, OldestMessage: time.Unix(timestamp, 0)},
+		{Name: "orders.shard-x", Messages: 7, Consumers: 1},
+		{Name: "payments", Messages: 11, Consumers: 1},
+	}
+
+	if matching := glob.filter(queues); len(matching) != 3 {
+		t.Error("Expected 3 queues matching the glob, got ", len(matching))
+	}
+
+	queue := &appQueue{vhost: "vhost", name: "orders", pattern: regex}
+	queue.update(regex.filter(queues)...)
+
+	if queue.matches != 2 || queue.messages != 8 || queue.consumers != 2 {
+		t.Error("Expected 2 queues, 8 messages and 2 consumers, got ", queue.matches, queue.messages, queue.consumers)
+	}
+
+	if rate, _ := queue.stats.publishRate(); rate != 3 {
+		t.Error("Expected a publish rate of 3, got ", rate)
+	}
+
+	if queue.oldestMessage.Unix() != timestamp {
+		t.Error("Expected the oldest message of the second shard, got ", queue.oldestMessage)
+	}
+
+	for _, invalid := range []string{"", "orders[", "/orders(/"} {
+		if _, err := parseQueuePattern("test", invalid); err == nil {
+			t.Error("Pattern should be invalid: ", invalid)
+		}
+	}
+}
+
+func TestParseQueues(t *testing.T) {
+	queues, err := parseQueues("test", "vhost/primary, %2F/retry:10,a/b/c,vhost/events:orders,vhost/events:2024:5,%2F/orders/eu:3", 2)
+
+	if err != nil {
+		t.Error("Queues should be valid", err)
+	}
+
+	if len(queues) != 6 {
+		t.Fatal("Expected 6 queues, got ", len(queues))
+	}
+
+	if queues[0].key() != "vhost/primary" || queues[0].messagesPerWorker != 2 {
+		t.Error("First queue not parsed correctly", queues[0])
+	}
+
+	if queues[1].vhost != "%2F" || queues[1].name != "retry" || queues[1].messagesPerWorker != 10 {
+		t.Error("Second queue not parsed correctly", queues[1])
+	}
+
+	// The vhost is escaped, the queue name may contain `/`
+	if queues[2].vhost != "a" || queues[2].name != "b/c" {
+		t.Error("Third queue not parsed correctly", queues[2])
+	}
+
+	// Only a numeric suffix is the messages per worker, the queue names may contain `:`
+	if queues[3].vhost != "vhost" || queues[3].name != "events:orders" || queues[3].messagesPerWorker != 2 {
+		t.Error("Fourth queue not parsed correctly", queues[3])
+	}
+
+	if queues[4].name != "events:2024" || queues[4].messagesPerWorker != 5 {
+		t.Error("Fifth queue not parsed correctly", queues[4])
+	}
+
+	if queues[5].vhost != "%2F" || queues[5].name != "orders/eu" || queues[5].messagesPerWorker != 3 {
+		t.Error("Sixth queue not parsed correctly", queues[5])
+	}
+
+	for _, invalid := range []string{"", "queue", "vhost/", "/queue", "vhost/queue:0", "vhost/queue:99999999999"} {
+		if _, err := parseQueues("test", invalid, 1); err == nil {
+			t.Error("Queues should be invalid: ", invalid)
+		}
+	}
+}
+
 func TestCoolDown(t *testing.T) {
 	isCoolDown := app.isCoolDown()
 
@@ -231,18 +615,12 @@ func TestCoolDown(t *testing.T) {
 }
 
 func TestCreateApp(t *testing.T) {
-	deployment := &v1beta1.Deployment{
-		ObjectMeta: v1.ObjectMeta{
-			Annotations: map[string]string{
-				"k8s-rmq-autoscaler/enable": "true",
-			},
-		},
-		Spec: v1beta1.DeploymentSpec{
-			Replicas: int32Ptr(2),
-		},
-		Status: v1beta1.DeploymentStatus{
-			ReadyReplicas: 1,
+	deployment := &workload{
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable": "true",
 		},
+		replicas:      2,
+		readyReplicas: 1,
 	}
 
 	app, err := createApp(deployment, "test")
@@ -250,60 +628,60 @@ func TestCreateApp(t *testing.T) {
 	if app != nil {
 		t.Error("App should not be created")
 	}
-	if err.Error() != "deployment: test has no property `queue` not filled" {
+	if err.Error() != "workload: test has no property `queue` not filled" {
 		t.Error("Error message not right", err)
 	}
 
 	// Add the missing information
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/queue"] = "queue"
+	deployment.annotations["k8s-rmq-autoscaler/queue"] = "queue"
 
 	app, err = createApp(deployment, "test")
 
 	if app != nil {
 		t.Error("App should not be created")
 	}
-	if err.Error() != "deployment: test has no property `vhost` not filled" {
+	if err.Error() != "workload: test has no property `vhost` not filled" {
 		t.Error("Error message not right", err)
 	}
 
 	// Add the missing information
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/vhost"] = "vhost"
+	deployment.annotations["k8s-rmq-autoscaler/vhost"] = "vhost"
 
 	app, err = createApp(deployment, "test")
 
 	if app != nil {
 		t.Error("App should not be created")
 	}
-	if err.Error() != "deployment: test has no property `min-workers` not filled" {
+	if err.Error() != "workload: test has no property `min-workers` not filled" {
 		t.Error("Error message not right", err)
 	}
 
 	// Add a non int value
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/min-workers"] = "nan"
+	deployment.annotations["k8s-rmq-autoscaler/min-workers"] = "nan"
 
 	app, err = createApp(deployment, "test")
 
 	if app != nil {
 		t.Error("App should not be created")
 	}
-	if err.Error() != "deployment: test property `min-workers` is not an int (ex: 1)" {
+	if err.Error() != "workload: test property `min-workers` is not an int (ex: 1)" {
 		t.Error("Error message not right", err)
 	}
 
 	// Add a missing value
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/min-workers"] = "1"
+	deployment.annotations["k8s-rmq-autoscaler/min-workers"] = "1"
 
 	app, err = createApp(deployment, "test")
 
 	if app != nil {
 		t.Error("App should not be created")
 	}
-	if err.Error() != "deployment: test has no property `max-workers` not filled" {
+	if err.Error() != "workload: test has no property `max-workers` not filled" {
 		t.Error("Error message not right", err)
 	}
 
 	// Add a missing value
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/max-workers"] = "2"
+	deployment.annotations["k8s-rmq-autoscaler/max-workers"] = "2"
 
 	app, err = createApp(deployment, "test")
 
@@ -349,7 +727,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/messages-per-worker"] = "2"
+	deployment.annotations["k8s-rmq-autoscaler/messages-per-worker"] = "2"
 
 	app, err = createApp(deployment, "test")
 
@@ -362,7 +740,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/steps"] = "2"
+	deployment.annotations["k8s-rmq-autoscaler/steps"] = "2"
 
 	app, err = createApp(deployment, "test")
 
@@ -375,7 +753,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/offset"] = "2"
+	deployment.annotations["k8s-rmq-autoscaler/offset"] = "2"
 
 	app, err = createApp(deployment, "test")
 
@@ -388,7 +766,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/override"] = "true"
+	deployment.annotations["k8s-rmq-autoscaler/override"] = "true"
 
 	app, err = createApp(deployment, "test")
 
@@ -401,7 +779,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/safe-unscale"] = "false"
+	deployment.annotations["k8s-rmq-autoscaler/safe-unscale"] = "false"
 
 	app, err = createApp(deployment, "test")
 
@@ -414,7 +792,7 @@ func TestCreateApp(t *testing.T) {
 	}
 
 	// Add a optional annotations
-	deployment.ObjectMeta.Annotations["k8s-rmq-autoscaler/cooldown-delay"] = "5m0s"
+	deployment.annotations["k8s-rmq-autoscaler/cooldown-delay"] = "5m0s"
 
 	app, err = createApp(deployment, "test")
 
@@ -425,4 +803,1099 @@ func TestCreateApp(t *testing.T) {
 	if app.coolDownDelay != 5*time.Minute {
 		t.Error("coolDownDelay not set correctly")
 	}
+
+	if app.ratePerWorker != 0 {
+		t.Error("ratePerWorker should be disabled by default")
+	}
+
+	if len(app.queues) != 1 || app.queues[0].key() != "vhost/queue" || app.aggregation != AggregationSum {
+		t.Error("queues not set correctly", app.queues)
+	}
+
+	if app.backend != DefaultBackend || app.queues[0].backend != DefaultBackend {
+		t.Error("backend default value not rabbitmq")
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/backend"] = "other"
+	deployment.annotations["k8s-rmq-autoscaler/cluster"] = "eu"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || app.backend != "other" || app.queues[0].snapshotKey() != (snapshotKey{backend: "other", cluster: "eu", vhost: "vhost"}) {
+		t.Error("backend and cluster not set correctly", err)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/backend")
+	delete(deployment.annotations, "k8s-rmq-autoscaler/cluster")
+
+	deployment.annotations["k8s-rmq-autoscaler/credentials-secret"] = "rmq"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || app.queues[0].snapshotKey().credentials != deployment.namespace+"/rmq" {
+		t.Error("credentials secret not set correctly", err)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/credentials-secret")
+
+	deployment.annotations["k8s-rmq-autoscaler/queues"] = "vhost/retry:5,other/priority"
+	deployment.annotations["k8s-rmq-autoscaler/queues-aggregation"] = "max"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || len(app.queues) != 3 || app.queues[1].messagesPerWorker != 5 || app.aggregation != AggregationMax {
+		t.Error("queues not set correctly", err)
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/queue-pattern"] = "queue.shard-*"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || len(app.queues) != 4 || app.queues[1].pattern == nil || app.queues[1].key() != "vhost/queue.shard-*" {
+		t.Error("queue pattern not set correctly", err)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/queue-pattern")
+
+	deployment.annotations["k8s-rmq-autoscaler/queues-aggregation"] = "avg"
+
+	app, err = createApp(deployment, "test")
+
+	if err == nil || err.Error() != "workload: test property `queues-aggregation` must be one of [sum max]" {
+		t.Error("Error should be thrown", err)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/queues-aggregation")
+	delete(deployment.annotations, "k8s-rmq-autoscaler/queues")
+
+	deployment.annotations["k8s-rmq-autoscaler/rate-per-worker"] = "0"
+
+	app, err = createApp(deployment, "test")
+
+	if err == nil || err.Error() != "workload: test property `rate-per-worker` must be greater than 0" {
+		t.Error("Error should be thrown", err)
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/rate-per-worker"] = "2.5"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || app.ratePerWorker != 2.5 {
+		t.Error("ratePerWorker not set correctly")
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/target-drain-time"] = "2m"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil || app.targetDrainTime != 2*time.Minute {
+		t.Error("targetDrainTime not set correctly")
+	}
+
+	if app.scaleToZero != false || app.idleDelay != 5*time.Minute || app.activationWorkers != 1 {
+		t.Error("scale to zero defaults not set correctly")
+	}
+
+	// Add a optional annotations
+	deployment.annotations["k8s-rmq-autoscaler/scale-to-zero"] = "true"
+	deployment.annotations["k8s-rmq-autoscaler/idle-delay"] = "1m0s"
+	deployment.annotations["k8s-rmq-autoscaler/activation-workers"] = "2"
+
+	app, err = createApp(deployment, "test")
+
+	if app == nil {
+		t.Error("App should be created with default values")
+	}
+
+	if app.scaleToZero != true || app.idleDelay != time.Minute || app.activationWorkers != 2 {
+		t.Error("scale to zero not set correctly")
+	}
+}
+
+func TestParkedApp(t *testing.T) {
+	deployment := &workload{
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/min-workers": "0",
+			"k8s-rmq-autoscaler/max-workers": "0",
+		},
+	}
+
+	// The activation workers are only checked with scale to zero
+	if app, err := createApp(deployment, "test"); app == nil {
+		t.Error("Parked app should be created", err)
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/scale-to-zero"] = "true"
+
+	if _, err := createApp(deployment, "test"); err == nil || err.Error() != "workload: test property `activation-workers` must be lower or equal to `max-workers`" {
+		t.Error("Error should be thrown", err)
+	}
+}
+
+func TestScaleToZero(t *testing.T) {
+	app := &App{
+		key:               "zero",
+		minWorkers:        1,
+		maxWorkers:        10,
+		messagesPerWorker: 1,
+		readyWorkers:      1,
+		replicas:          1,
+		steps:             1,
+		scaleToZero:       true,
+		idleDelay:         time.Minute,
+		activationWorkers: 2,
+		createdDate:       time.Now(),
+	}
+
+	incReplicas := app.scale(1, 0)
+
+	// Queue just got empty, wait for the idle delay
+	if incReplicas != 0 {
+		t.Error("Expected 0, got ", incReplicas)
+	}
+
+	if app.idleSince.IsZero() {
+		t.Error("idleSince should be set")
+	}
+
+	app.idleSince = app.idleSince.Add(-time.Minute)
+	incReplicas = app.scale(1, 0)
+
+	// Idle for long enough, scale to zero
+	if incReplicas != -1 {
+		t.Error("Expected -1, got ", incReplicas)
+	}
+
+	app.readyWorkers = 0
+	app.replicas = 0
+	incReplicas = app.scale(0, 0)
+
+	// Nothing in queue, stay at zero
+	if incReplicas != 0 {
+		t.Error("Expected 0, got ", incReplicas)
+	}
+
+	incReplicas = app.scale(0, 5)
+
+	// First messages, wake up with the activation workers
+	if incReplicas != 2 {
+		t.Error("Expected 2, got ", incReplicas)
+	}
+
+	if app.decision != decisionUp {
+		t.Error("Expected up decision, got ", app.decision)
+	}
+
+	app.readyWorkers = 2
+	app.replicas = 2
+	app.idleSince = time.Now().Add(-time.Hour)
+	incReplicas = app.scale(2, 5)
+
+	// Messages in queue reset the idle time
+	if !app.idleSince.IsZero() {
+		t.Error("idleSince should be reset")
+	}
+
+	if incReplicas != 1 {
+		t.Error("Expected 1, got ", incReplicas)
+	}
+}
+
+func TestNewWorkload(t *testing.T) {
+	resource := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      "worker",
+			"namespace": "namespace",
+			"annotations": map[string]interface{}{
+				"k8s-rmq-autoscaler/enable": "true",
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+		},
+		"status": map[string]interface{}{
+			"readyReplicas": int64(2),
+		},
+	}}
+
+	workload := newWorkload(resource, object)
+
+	if workload.key() != "statefulsets.apps/namespace/worker" {
+		t.Error("key not right", workload.key())
+	}
+	if workload.replicas != 3 {
+		t.Error("replicas not read correctly")
+	}
+	if workload.readyReplicas != 2 {
+		t.Error("readyReplicas not read correctly")
+	}
+	if !isEnabled(workload) {
+		t.Error("annotations not read correctly")
+	}
+
+	unstructured.RemoveNestedField(object.Object, "spec", "replicas")
+	workload = newWorkload(resource, object)
+
+	if workload.replicas != 1 {
+		t.Error("replicas default value not 1")
+	}
+}
+
+func TestControlledWorkload(t *testing.T) {
+	hub := &Autoscaler{
+		apps:      make(map[string]*App),
+		snapshots: newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: staticSource{}}}, 0),
+		recorder:  record.NewFakeRecorder(100),
+	}
+	resource := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      "worker-5d9c7b",
+			"namespace": "namespace",
+			"annotations": map[string]interface{}{
+				"k8s-rmq-autoscaler/enable":      "true",
+				"k8s-rmq-autoscaler/queue":       "queue",
+				"k8s-rmq-autoscaler/vhost":       "vhost",
+				"k8s-rmq-autoscaler/min-workers": "1",
+				"k8s-rmq-autoscaler/max-workers": "10",
+			},
+		},
+	}}
+
+	hub.addWorkload(newWorkload(resource, object))
+
+	if len(hub.apps) != 1 {
+		t.Error("ReplicaSet without owner should be autoscaled, got ", len(hub.apps))
+	}
+
+	// The Deployment controller adopts the ReplicaSet and copies the annotations of the Deployment
+	controller := true
+	object.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "worker", Controller: &controller}})
+	owned := newWorkload(resource, object)
+
+	if owned.controller != "Deployment/worker" {
+		t.Error("Expected Deployment/worker, got ", owned.controller)
+	}
+
+	hub.addWorkload(owned)
+
+	if len(hub.apps) != 0 || len(hub.rejected) != 0 {
+		t.Error("ReplicaSet owned by a Deployment should be ignored, got ", len(hub.apps), len(hub.rejected))
+	}
+}
+
+func TestParseResources(t *testing.T) {
+	resources, err := parseResources(DefaultResources + ",foos.v1alpha1.example.com")
+
+	if err != nil {
+		t.Error("Resources should be parsed", err)
+	}
+	if len(resources) != 4 {
+		t.Error("Expected 4 resources, got ", len(resources))
+	}
+	if resources[3] != (schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "foos"}) {
+		t.Error("custom resource not parsed correctly", resources[3])
+	}
+
+	_, err = parseResources("deployments")
+
+	if err == nil {
+		t.Error("Resource without version and group should not be parsed")
+	}
+}
+
+func TestScaleConflict(t *testing.T) {
+	scaler := &fakeScales{replicas: 1, conflicts: 2}
+	deployment := &workload{
+		resource:  schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		namespace: "namespace",
+		name:      "worker",
+	}
+
+	err := deployment.scale(context.Background(), scaler, 3)
+
+	if err != nil {
+		t.Error("Scale should be retried on conflict", err)
+	}
+	if scaler.replicas != 3 {
+		t.Error("Expected 3, got ", scaler.replicas)
+	}
+	if scaler.updates != 3 {
+		t.Error("Expected 3 updates, got ", scaler.updates)
+	}
+}
+
+// workerScales stores the replicas of several workloads, the slow workload is only read once released
+type workerScales struct {
+	mu       sync.Mutex
+	replicas map[string]int32
+	slow     string
+	waiting  chan struct{}
+	release  chan struct{}
+}
+
+func (f *workerScales) Scales(namespace string) scale.ScaleInterface {
+	return f
+}
+
+func (f *workerScales) Get(resource schema.GroupResource, name string) (*autoscalingv1.Scale, error) {
+	if name == f.slow {
+		close(f.waiting)
+		<-f.release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &autoscalingv1.Scale{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: autoscalingv1.ScaleSpec{Replicas: f.replicas[name]}}, nil
+}
+
+func (f *workerScales) Update(resource schema.GroupResource, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replicas[scale.Name] = scale.Spec.Replicas
+	return scale, nil
+}
+
+func TestTick(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"name": "worker-0", "consumers": 1, "messages": 5},
+			{"name": "worker-1", "consumers": 1, "messages": 5},
+			{"name": "worker-2", "consumers": 1, "messages": 5}
+		]`))
+	}))
+	defer server.Close()
+
+	rmq, _ := newRmq(server.URL, "user", "password", server.Client())
+	scales := &workerScales{
+		replicas: map[string]int32{"worker-0": 1, "worker-1": 1, "worker-2": 1},
+		slow:     "worker-0",
+		waiting:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	recorder := record.NewFakeRecorder(100)
+	hub := &Autoscaler{
+		apps:       make(map[string]*App),
+		snapshots:  newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: rmq}}, 0),
+		workers:    2,
+		appTimeout: 5 * time.Second,
+		recorder:   recorder,
+	}
+
+	for name := range scales.replicas {
+		deployment := &workload{
+			resource:      schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			namespace:     "namespace",
+			name:          name,
+			replicas:      1,
+			readyReplicas: 1,
+			annotations: map[string]string{
+				"k8s-rmq-autoscaler/enable":      "true",
+				"k8s-rmq-autoscaler/queue":       name,
+				"k8s-rmq-autoscaler/vhost":       "vhost",
+				"k8s-rmq-autoscaler/min-workers": "1",
+				"k8s-rmq-autoscaler/max-workers": "5",
+			},
+		}
+		app, _ := createApp(deployment, deployment.key())
+		hub.apps[app.key] = app
+	}
+
+	done := make(chan struct{})
+	go func() {
+		hub.tick(context.Background(), scales)
+		close(done)
+	}()
+
+	<-scales.waiting
+
+	// The registry is not locked while an app is scaled
+	hub.removeApp("deployments.apps/namespace/worker-2")
+
+	close(scales.release)
+	<-done
+
+	if scales.replicas["worker-0"] != 2 || scales.replicas["worker-1"] != 2 {
+		t.Error("Expected 2 replicas, got ", scales.replicas)
+	}
+
+	if len(hub.listApps()) != 2 {
+		t.Error("Expected 2 apps, got ", len(hub.listApps()))
+	}
+
+	// The app removed during the tick was listed before, it's scaled too
+	if len(recorder.Events) != 3 {
+		t.Fatal("Expected 3 events, got ", len(recorder.Events))
+	}
+
+	for i := 0; i < 3; i++ {
+		if event := <-recorder.Events; event != "Normal ScaledUp Scaled from 1 to 2 replicas (queue: 5 / consumers: 1)" {
+			t.Error("Unexpected event ", event)
+		}
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	source := staticSource{}
+	recorder := record.NewFakeRecorder(100)
+	hub := &Autoscaler{
+		snapshots: newSnapshotter(queueSources{"static": {DefaultCluster: source}}, 0),
+		recorder:  recorder,
+	}
+	deployment := &workload{
+		resource:      schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		namespace:     "namespace",
+		name:          "worker",
+		replicas:      5,
+		readyReplicas: 5,
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":            "true",
+			"k8s-rmq-autoscaler/queue":             "queue",
+			"k8s-rmq-autoscaler/vhost":             "vhost",
+			"k8s-rmq-autoscaler/backend":           "static",
+			"k8s-rmq-autoscaler/min-workers":       "1",
+			"k8s-rmq-autoscaler/max-workers":       "10",
+			"k8s-rmq-autoscaler/failure-policy":    "fallback",
+			"k8s-rmq-autoscaler/failure-threshold": "2",
+			"k8s-rmq-autoscaler/fallback-replicas": "3",
+		},
+	}
+	app, err := createApp(deployment, deployment.key())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scales := &fakeScales{replicas: 5}
+	autoscale := func() {
+		snapshot := hub.snapshots.refresh(context.Background(), snapshotKeys([]*App{app}))
+		hub.autoscale(context.Background(), app, scales, snapshot)
+	}
+	rmqErrors := testutil.ToFloat64(rmqErrorsCounter.WithLabelValues(app.key))
+	notFoundErrors := testutil.ToFloat64(appQueueErrorsCounter.WithLabelValues(app.key, string(SourceNotFound)))
+
+	// The queue doesn't exist, the replicas are kept until the threshold
+	autoscale()
+
+	if app.failures != 1 || app.decision != decisionFailure || scales.replicas != 5 {
+		t.Error("Expected 1 failure and 5 replicas, got ", app.failures, scales.replicas)
+	}
+
+	notFound := "Warning QueueNotFound Unable to fetch queue queue on vhost vhost: queue queue not found on vhost vhost"
+
+	if event := <-recorder.Events; event != notFound {
+		t.Error("Unexpected event ", event)
+	}
+
+	autoscale()
+
+	if app.failures != 2 || scales.replicas != 3 {
+		t.Error("Expected 2 failures and 3 replicas, got ", app.failures, scales.replicas)
+	}
+
+	if event := <-recorder.Events; event != notFound {
+		t.Error("Unexpected event ", event)
+	}
+
+	if event := <-recorder.Events; event != "Normal ScaledDown Scaled from 5 to 3 replicas (failure policy fallback after 2 failures)" {
+		t.Error("Unexpected event ", event)
+	}
+
+	if count := testutil.ToFloat64(rmqErrorsCounter.WithLabelValues(app.key)) - rmqErrors; count != 2 {
+		t.Error("Expected 2 errors, got ", count)
+	}
+
+	if count := testutil.ToFloat64(appQueueErrorsCounter.WithLabelValues(app.key, string(SourceNotFound))) - notFoundErrors; count != 2 {
+		t.Error("Expected 2 NotFound errors, got ", count)
+	}
+
+	// Failures are kept when the app is updated
+	updated, _ := createApp(deployment, deployment.key())
+	updated.inherit(app)
+
+	if updated.failures != 2 {
+		t.Error("Expected 2 failures, got ", updated.failures)
+	}
+
+	app.replicas = 3
+	app.readyWorkers = 3
+	hub.snapshots.sources["static"][DefaultCluster] = staticSource{{Name: "queue", Messages: 3, Consumers: 3}}
+	autoscale()
+
+	if app.failures != 0 || app.decision == decisionFailure {
+		t.Error("Failures should be reset, got ", app.failures, app.decision)
+	}
+
+	// A cluster that is not configured is not a failure of the broker
+	app.queues[0].cluster = "asia"
+	autoscale()
+
+	if app.failures != 0 || app.decision != decisionFailure || scales.replicas != 3 {
+		t.Error("Configuration error should not count as a failure, got ", app.failures, app.decision, scales.replicas)
+	}
+
+	if event := <-recorder.Events; event != "Warning QueueFetchFailed Unable to fetch queue queue on vhost vhost: cluster asia is not configured for backend static" {
+		t.Error("Unexpected event ", event)
+	}
+
+	app.queues[0].cluster = DefaultCluster
+
+	// and the app is rejected when it's created
+	deployment.annotations["k8s-rmq-autoscaler/cluster"] = "asia"
+	hub.addWorkload(deployment)
+
+	if len(hub.apps) != 0 || len(hub.rejected) != 1 {
+		t.Error("App with an unknown cluster should be rejected, got ", hub.apps)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/cluster")
+
+	app.failurePolicy = FailurePolicyMin
+
+	if replicas, ok := app.failurePolicyReplicas(); ok {
+		t.Error("Failure policy should not apply below the threshold, got ", replicas)
+	}
+
+	app.failures = 2
+
+	if replicas, ok := app.failurePolicyReplicas(); !ok || replicas != 1 {
+		t.Error("Expected 1, got ", replicas)
+	}
+
+	app.failurePolicy = FailurePolicyHold
+
+	if _, ok := app.failurePolicyReplicas(); ok {
+		t.Error("Hold policy should keep the replicas")
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/fallback-replicas")
+
+	if _, err := createApp(deployment, deployment.key()); err == nil {
+		t.Error("Fallback policy without fallback-replicas should fail")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	recorder := record.NewFakeRecorder(100)
+	hub := &Autoscaler{
+		snapshots: newSnapshotter(queueSources{"static": {DefaultCluster: staticSource{{Name: "queue", Messages: 5, Consumers: 1}}}}, 0),
+		recorder:  recorder,
+	}
+	deployment := &workload{
+		resource:      schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		namespace:     "namespace",
+		name:          "worker",
+		replicas:      1,
+		readyReplicas: 1,
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/backend":     "static",
+			"k8s-rmq-autoscaler/min-workers": "1",
+			"k8s-rmq-autoscaler/max-workers": "10",
+			"k8s-rmq-autoscaler/dry-run":     "true",
+		},
+	}
+	app, err := createApp(deployment, deployment.key())
+
+	if err != nil || !app.dryRun {
+		t.Fatal("dry-run not set correctly", err)
+	}
+
+	scales := &fakeScales{replicas: 1}
+	snapshot := hub.snapshots.refresh(context.Background(), snapshotKeys([]*App{app}))
+	hub.autoscale(context.Background(), app, scales, snapshot)
+
+	if scales.updates != 0 || app.decision != decisionUp || app.desiredReplicas != 2 || !app.lastScaleTime.IsZero() {
+		t.Error("Expected an up decision without update, got ", scales.updates, app.decision, app.desiredReplicas)
+	}
+
+	if event := <-recorder.Events; event != "Normal DryRun Would scale from 1 to 2 replicas (queue: 5 / consumers: 1)" {
+		t.Error("Unexpected event ", event)
+	}
+
+	// Global dry run
+	app.dryRun = false
+	hub.dryRun = true
+	hub.autoscale(context.Background(), app, scales, snapshot)
+
+	if scales.updates != 0 {
+		t.Error("Expected no update, got ", scales.updates)
+	}
+
+	hub.dryRun = false
+	hub.autoscale(context.Background(), app, scales, snapshot)
+
+	if scales.updates != 1 || scales.replicas != 2 {
+		t.Error("Expected 2 replicas, got ", scales.replicas)
+	}
+}
+
+func TestPauseAndPin(t *testing.T) {
+	hub := &Autoscaler{
+		apps:      make(map[string]*App),
+		snapshots: newSnapshotter(queueSources{"static": {DefaultCluster: staticSource{{Name: "queue", Messages: 5, Consumers: 2}}}}, 0),
+		recorder:  record.NewFakeRecorder(100),
+	}
+	deployment := &workload{
+		resource:      schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		namespace:     "namespace",
+		name:          "worker",
+		replicas:      2,
+		readyReplicas: 2,
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/backend":     "static",
+			"k8s-rmq-autoscaler/min-workers": "1",
+			"k8s-rmq-autoscaler/max-workers": "10",
+			"k8s-rmq-autoscaler/paused":      "true",
+		},
+	}
+	scales := &fakeScales{replicas: 2}
+	autoscale := func() *App {
+		hub.addWorkload(deployment)
+		app := hub.listApps()[0]
+		hub.autoscale(context.Background(), app, scales, hub.snapshots.refresh(context.Background(), snapshotKeys([]*App{app})))
+		return app
+	}
+
+	if app := autoscale(); app.decision != decisionPaused || app.reason != "paused by the annotations" || scales.updates != 0 {
+		t.Error("Paused app should not be scaled, got ", app.decision, scales.updates)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/paused")
+	deployment.annotations["k8s-rmq-autoscaler/pin-replicas"] = "20"
+	deployment.annotations["k8s-rmq-autoscaler/pin-until"] = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// The pin ignores the limits and the steps
+	if app := autoscale(); app.decision != decisionPinned || scales.replicas != 20 {
+		t.Error("Expected 20 replicas, got ", app.decision, scales.replicas)
+	}
+
+	// The control is handed back once the pin expired
+	deployment.annotations["k8s-rmq-autoscaler/pin-until"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	if app := autoscale(); app.decision != decisionUp {
+		t.Error("Expired pin should be ignored, got ", app.decision)
+	}
+
+	delete(deployment.annotations, "k8s-rmq-autoscaler/pin-until")
+
+	if _, err := createApp(deployment, deployment.key()); err == nil || err.Error() != "workload: deployments.apps/namespace/worker has no property `pin-until` not filled" {
+		t.Error("pin-replicas without pin-until should fail", err)
+	}
+
+	deployment.annotations["k8s-rmq-autoscaler/pin-until"] = "tomorrow"
+
+	if _, err := createApp(deployment, deployment.key()); err == nil {
+		t.Error("Invalid pin-until should fail")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	deployment := &workload{
+		annotations: map[string]string{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/min-workers": "1",
+			"k8s-rmq-autoscaler/max-workers": "10",
+			"k8s-rmq-autoscaler/offset":      "1",
+			"k8s-rmq-autoscaler/schedule": `
+- name: business-hours
+  cron: "0 8 * * 1-5"
+  duration: 10h
+  timezone: Europe/Paris
+  minWorkers: 5
+  maxWorkers: 50
+- cron: "@daily"
+  duration: 24h
+  maxWorkers: 3`,
+		},
+	}
+
+	app, err := createApp(deployment, "test")
+
+	if err != nil || len(app.schedule) != 2 || app.schedule[1].Name != "window-1" {
+		t.Error("Schedule not set correctly", err)
+	}
+
+	// Monday 08:30 in Paris, both windows are open, the first one wins
+	app.applySchedule(time.Date(2019, 1, 7, 7, 30, 0, 0, time.UTC))
+
+	if app.window != "business-hours" || app.minWorkers != 5 || app.maxWorkers != 50 || app.offset != 1 {
+		t.Error("Expected business-hours limits, got ", app.window, app.minWorkers, app.maxWorkers, app.offset)
+	}
+
+	// Monday 18:30 in Paris, the business hours are over
+	app.applySchedule(time.Date(2019, 1, 7, 17, 30, 0, 0, time.UTC))
+
+	if app.window != "window-1" || app.minWorkers != 1 || app.maxWorkers != 3 {
+		t.Error("Expected window-1 limits, got ", app.window, app.minWorkers, app.maxWorkers)
+	}
+
+	// Saturday 10:00, only the daily window is open
+	if app.schedule[0].isOpen(time.Date(2019, 1, 5, 9, 0, 0, 0, time.UTC)) {
+		t.Error("business-hours should be closed on saturday")
+	}
+
+	app.schedule = app.schedule[:1]
+	app.applySchedule(time.Date(2019, 1, 5, 9, 0, 0, 0, time.UTC))
+
+	if app.window != "" || app.minWorkers != 1 || app.maxWorkers != 10 || app.offset != 1 {
+		t.Error("Expected the default limits, got ", app.window, app.minWorkers, app.maxWorkers, app.offset)
+	}
+
+	if config := app.config(); config.MaxWorkers != 10 || len(config.Schedule) != 1 {
+		t.Error("Admin config should show the default limits, got ", config.MaxWorkers, config.Schedule)
+	}
+
+	invalid := []string{
+		`- {cron: "0 25 * * *", duration: 1h}`,
+		`- {cron: "0 8 * * *", duration: 0s}`,
+		`- {cron: "0 8 * * *", duration: 1h, timezone: Mars/Olympus}`,
+		`- {cron: "0 8 * * *", duration: 1h, minWorkers: 20}`,
+		`{cron: "0 8 * * *"}`,
+	}
+
+	for _, schedule := range invalid {
+		deployment.annotations["k8s-rmq-autoscaler/schedule"] = schedule
+
+		if _, err := createApp(deployment, "test"); err == nil {
+			t.Error("Invalid schedule should fail ", schedule)
+		}
+	}
+}
+
+func TestBehavior(t *testing.T) {
+	behavior, err := parseBehavior("test", `
+scaleUp:
+  policies:
+  - {type: Pods, value: 4, periodSeconds: 60}
+  - {type: Percent, value: 100, periodSeconds: 60}
+scaleDown:
+  stabilizationWindowSeconds: 300
+`)
+
+	if err != nil {
+		t.Error("Behavior should be parsed", err)
+	}
+
+	app := &App{
+		key:               "key",
+		minWorkers:        1,
+		maxWorkers:        50,
+		messagesPerWorker: 1,
+		readyWorkers:      10,
+		replicas:          10,
+		steps:             1,
+		behavior:          behavior,
+	}
+
+	// Max of 14 with the Pods policy and 20 with the Percent policy
+	if increment := app.scale(10, 30); increment != 10 || app.decision != decisionUp {
+		t.Error("Expected 10, got ", increment)
+	}
+
+	app.behavior.ScaleUp.SelectPolicy = MinPolicySelect
+
+	if increment := app.scale(10, 30); increment != 4 {
+		t.Error("Expected 4, got ", increment)
+	}
+
+	// The scale up of the period is taken into account
+	app.recordScaleEvent(time.Now(), 4)
+	app.replicas, app.readyWorkers = 14, 14
+
+	if increment := app.scale(14, 30); increment != 0 || app.decision != decisionNone {
+		t.Error("Expected 0, got ", increment, app.decision)
+	}
+
+	// The highest recommendation of the window is kept
+	if increment := app.scale(14, 2); increment != 0 || app.decision != decisionStabilized {
+		t.Error("Expected a stabilized decision, got ", increment, app.decision)
+	}
+
+	// Without scale down policies, the steps are used once the window is over
+	for i := range app.recommendations {
+		app.recommendations[i].time = app.recommendations[i].time.Add(-10 * time.Minute)
+	}
+
+	if increment := app.scale(14, 2); increment != -1 || app.decision != decisionDown {
+		t.Error("Expected -1, got ", increment, app.decision)
+	}
+
+	app.behavior.ScaleDown = &ScalingRules{Policies: []ScalingPolicy{{Type: PercentScalingPolicy, Value: 50, PeriodSeconds: 60}}}
+
+	if increment := app.scale(14, 0); increment != -7 {
+		t.Error("Expected -7, got ", increment)
+	}
+
+	app.behavior.ScaleDown.SelectPolicy = DisabledPolicySelect
+
+	if increment := app.scale(14, 0); increment != 0 || app.decision != decisionNone {
+		t.Error("Expected 0, got ", increment, app.decision)
+	}
+
+	invalid := []string{
+		`scaleUp: {policies: [{type: Replicas, value: 1, periodSeconds: 60}]}`,
+		`scaleUp: {policies: [{type: Pods, value: 0, periodSeconds: 60}]}`,
+		`scaleDown: {policies: [{type: Pods, value: 1, periodSeconds: 3600}]}`,
+		`scaleDown: {selectPolicy: Always}`,
+		`scaleDown: {stabilizationWindowSeconds: 7200}`,
+		`- scaleUp`,
+	}
+
+	for _, behavior := range invalid {
+		if _, err := parseBehavior("test", behavior); err == nil {
+			t.Error("Invalid behavior should fail ", behavior)
+		}
+	}
+}
+
+func TestRabbitScaler(t *testing.T) {
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "xcid.github.io/v1alpha1",
+		"kind":       "RabbitScaler",
+		"metadata": map[string]interface{}{
+			"name":      "scaler",
+			"namespace": "namespace",
+		},
+		"spec": map[string]interface{}{
+			"scaleTargetRef": map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"name":       "worker",
+			},
+			"queue":         "queue",
+			"vhost":         "vhost",
+			"minWorkers":    int64(1),
+			"maxWorkers":    int64(5),
+			"steps":         int64(2),
+			"safeUnscale":   false,
+			"cooldownDelay": "1m0s",
+			"queues": []interface{}{
+				map[string]interface{}{"vhost": "vhost", "queue": "retry", "messagesPerWorker": int64(10)},
+				map[string]interface{}{"vhost": "vhost", "queue": "events:2024"},
+			},
+		},
+	}}
+
+	scaler, err := newRabbitScaler(object)
+
+	if err != nil {
+		t.Error("RabbitScaler should be read", err)
+	}
+	if scaler.key() != "namespace/scaler" {
+		t.Error("key not right", scaler.key())
+	}
+	if scaler.Spec.ScaleTargetRef.Name != "worker" {
+		t.Error("scaleTargetRef not read correctly")
+	}
+
+	app, err := createApp(&workload{annotations: scaler.annotations(), replicas: 1}, "test")
+
+	if err != nil {
+		t.Error("App should be created from the RabbitScaler", err)
+	}
+	if app.queue != "queue" || app.vhost != "vhost" {
+		t.Error("queue not set correctly")
+	}
+	if len(app.queues) != 3 || app.queues[1].key() != "vhost/retry" || app.queues[1].messagesPerWorker != 10 {
+		t.Error("queues not set correctly")
+	}
+	if app.queues[2].key() != "vhost/events:2024" || app.queues[2].messagesPerWorker != 1 {
+		t.Error("queue name ending with digits not set correctly", app.queues[2])
+	}
+	if app.minWorkers != 1 || app.maxWorkers != 5 {
+		t.Error("workers limits not set correctly")
+	}
+	if app.steps != 2 {
+		t.Error("steps not set correctly")
+	}
+	if app.messagesPerWorker != 1 {
+		t.Error("messagesPerWorker default value not 1")
+	}
+	if app.safeUnscale != false {
+		t.Error("safeUnscale not set correctly")
+	}
+	if app.coolDownDelay != time.Minute {
+		t.Error("coolDownDelay not set correctly")
+	}
+}
+
+func TestRabbitScalerTarget(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, meta.RESTScopeNamespace)
+
+	client := &fakeObjects{objects: map[string]*unstructured.Unstructured{
+		"scaler": {Object: map[string]interface{}{
+			"apiVersion": "xcid.github.io/v1alpha1",
+			"kind":       "RabbitScaler",
+			"metadata":   map[string]interface{}{"name": "scaler", "namespace": "namespace", "resourceVersion": "1"},
+		}},
+	}}
+	recorder := record.NewFakeRecorder(100)
+	hub := &Autoscaler{
+		apps:              make(map[string]*App),
+		scalers:           make(map[string]*RabbitScaler),
+		scalerTargets:     make(map[string]string),
+		unresolvedScalers: make(map[string]*RabbitScaler),
+		resources:         map[schema.GroupVersionResource]bool{{Group: "apps", Version: "v1", Resource: "deployments"}: true},
+		snapshots:         newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: staticSource{}}}, 0),
+		clients:           &clients{dynamic: client, requests: client, mapper: mapper},
+		recorder:          recorder,
+	}
+	scaler := &RabbitScaler{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "scaler"}}
+	scaler.Spec.ScaleTargetRef = autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "worker"}
+	scaler.Spec.Queue, scaler.Spec.Vhost, scaler.Spec.MaxWorkers = "queue", "vhost", 5
+
+	validity := func() string {
+		hub.flushValidities()
+		status, _, _ := unstructured.NestedSlice(client.objects["scaler"].Object, "status", "conditions")
+		if len(status) != 1 {
+			return ""
+		}
+		return status[0].(map[string]interface{})["reason"].(string)
+	}
+
+	// The RabbitScaler is created before its Deployment
+	hub.addRabbitScaler(scaler)
+
+	if len(hub.apps) != 0 || hub.unresolvedScalers[scaler.key()] != scaler {
+		t.Error("RabbitScaler should wait for its target, got ", hub.apps)
+	}
+
+	if hub.validities[scaler.key()].reason != TargetNotFoundReason || client.objects["scaler"].Object["status"] != nil {
+		t.Error("Status should only be written by the leader, got ", client.objects["scaler"].Object)
+	}
+
+	if reason := validity(); reason != TargetNotFoundReason {
+		t.Error("Expected ", TargetNotFoundReason, ", got ", reason)
+	}
+
+	client.objects["worker"] = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{"name": "worker", "namespace": "namespace", "annotations": map[string]interface{}{
+			"k8s-rmq-autoscaler/enable":      "true",
+			"k8s-rmq-autoscaler/queue":       "queue",
+			"k8s-rmq-autoscaler/vhost":       "vhost",
+			"k8s-rmq-autoscaler/min-workers": "1",
+			"k8s-rmq-autoscaler/max-workers": "3",
+		}},
+		"spec": map[string]interface{}{"replicas": int64(2)},
+	}}
+	hub.retryRabbitScalers()
+
+	if app, ok := hub.apps["deployments.apps/namespace/worker"]; !ok || app.maxWorkers != 5 || len(hub.unresolvedScalers) != 0 {
+		t.Error("RabbitScaler should be resolved once its target exists, got ", hub.apps)
+	}
+
+	if reason := validity(); reason != ValidSpecReason {
+		t.Error("Expected ", ValidSpecReason, ", got ", reason)
+	}
+
+	// The StatefulSets are not watched, the replicas of the target would never be updated
+	client.objects["db"] = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "StatefulSet",
+		"metadata":   map[string]interface{}{"name": "db", "namespace": "namespace"},
+		"spec":       map[string]interface{}{"replicas": int64(2)},
+	}}
+	retargeted := *scaler
+	retargeted.Generation = 2
+	retargeted.Spec.ScaleTargetRef = autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db"}
+	hub.addRabbitScaler(&retargeted)
+
+	if len(hub.apps) != 1 || len(hub.scalers) != 0 || len(hub.unresolvedScalers) != 0 {
+		t.Error("RabbitScaler with a target not watched should be rejected, got ", hub.apps)
+	}
+
+	// The released Deployment is scaled from its annotations again
+	if app, ok := hub.apps["deployments.apps/namespace/worker"]; !ok || app.maxWorkers != 3 || app.scaler != nil {
+		t.Error("Released target should use its annotations, got ", hub.apps)
+	}
+
+	if reason := validity(); reason != TargetNotWatchedReason {
+		t.Error("Expected ", TargetNotWatchedReason, ", got ", reason)
+	}
+
+	if event := <-recorder.Events; event != "Warning TargetNotWatched RabbitScaler namespace/scaler target statefulsets.apps/namespace/db is not watched, add statefulsets.v1.apps to RESOURCES" {
+		t.Error("Expected a TargetNotWatched event, got ", event)
+	}
+
+	hub.removeRabbitScaler(scaler)
+
+	if len(hub.apps) != 1 || len(hub.validities) != 0 {
+		t.Error("RabbitScaler should be removed, got ", hub.apps)
+	}
+
+	// Removing the RabbitScaler of a target releases it as well
+	hub.addRabbitScaler(scaler)
+
+	if app := hub.apps["deployments.apps/namespace/worker"]; app == nil || app.maxWorkers != 5 {
+		t.Error("RabbitScaler should take the target back, got ", hub.apps)
+	}
+
+	hub.removeRabbitScaler(scaler)
+
+	if app := hub.apps["deployments.apps/namespace/worker"]; app == nil || app.maxWorkers != 3 || len(hub.scalerWorkloads) != 0 {
+		t.Error("Removed RabbitScaler target should use its annotations, got ", hub.apps)
+	}
+
+	// A second RabbitScaler of the same target waits for the first one to release it
+	other := &RabbitScaler{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "other"}, Spec: scaler.Spec}
+	other.Spec.MaxWorkers = 8
+	hub.addRabbitScaler(scaler)
+	hub.addRabbitScaler(other)
+
+	if app := hub.apps["deployments.apps/namespace/worker"]; app == nil || app.scaler != scaler || hub.unresolvedScalers[other.key()] != other {
+		t.Error("First RabbitScaler should keep its target, got ", hub.apps)
+	}
+
+	if validity := hub.validities[other.key()]; validity.reason != TargetConflictReason || validity.message != "RabbitScaler namespace/other target deployments.apps/namespace/worker is already scaled by the RabbitScaler namespace/scaler" {
+		t.Error("Expected ", TargetConflictReason, ", got ", validity)
+	}
+
+	hub.removeRabbitScaler(scaler)
+	hub.retryRabbitScalers()
+
+	if app := hub.apps["deployments.apps/namespace/worker"]; app == nil || app.scaler != other || app.maxWorkers != 8 || len(hub.unresolvedScalers) != 0 {
+		t.Error("Second RabbitScaler should take the released target, got ", hub.apps)
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	status := &RabbitScalerStatus{}
+
+	setCondition(status, ConditionActive, "True", QueueFetchedReason, "")
+	transition := status.Conditions[0].LastTransitionTime
+	status.Conditions[0].LastTransitionTime.Time = transition.Add(-time.Minute)
+
+	setCondition(status, ConditionActive, "True", QueueFetchedReason, "fetched")
+
+	if len(status.Conditions) != 1 {
+		t.Error("Expected 1 condition, got ", len(status.Conditions))
+	}
+	if status.Conditions[0].Message != "fetched" {
+		t.Error("message not updated")
+	}
+	if !status.Conditions[0].LastTransitionTime.Equal(&metav1.Time{Time: transition.Add(-time.Minute)}) {
+		t.Error("transition time should not change with the same status")
+	}
+
+	setCondition(status, ConditionActive, "False", QueueFetchFailedReason, "error")
+
+	if status.Conditions[0].LastTransitionTime.Time.Before(transition.Time) {
+		t.Error("transition time should change with the status")
+	}
 }
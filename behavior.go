@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PodsScalingPolicy The policy allows to add or remove a number of replicas during its period
+	PodsScalingPolicy = "Pods"
+	// PercentScalingPolicy The policy allows to add or remove a percentage of the replicas during its period
+	PercentScalingPolicy = "Percent"
+
+	// MaxPolicySelect The policy allowing the biggest change is used (Default)
+	MaxPolicySelect = "Max"
+	// MinPolicySelect The policy allowing the smallest change is used
+	MinPolicySelect = "Min"
+	// DisabledPolicySelect The scaling in this direction is disabled
+	DisabledPolicySelect = "Disabled"
+
+	maxStabilizationWindowSeconds = 3600
+	maxPolicyPeriodSeconds        = 1800
+
+	decisionStabilized = "stabilized"
+
+	invalidBehaviorError = "workload: %s property `%s` is not valid (%s)"
+)
+
+// ScalingBehavior scaling rules of each direction, same as the behavior of an autoscaling/v2 HorizontalPodAutoscaler
+type ScalingBehavior struct {
+	ScaleUp   *ScalingRules `json:"scaleUp,omitempty"`
+	ScaleDown *ScalingRules `json:"scaleDown,omitempty"`
+}
+
+// ScalingRules limits the replicas changes of one direction.
+// Without policies the changes are limited by the steps
+type ScalingRules struct {
+	StabilizationWindowSeconds int32           `json:"stabilizationWindowSeconds,omitempty"`
+	SelectPolicy               string          `json:"selectPolicy,omitempty"`
+	Policies                   []ScalingPolicy `json:"policies,omitempty"`
+}
+
+// ScalingPolicy change allowed during a period, in replicas (Pods) or percentage of the replicas (Percent)
+type ScalingPolicy struct {
+	Type          string `json:"type"`
+	Value         int32  `json:"value"`
+	PeriodSeconds int32  `json:"periodSeconds"`
+}
+
+// recommendation replicas wanted by the queues on a tick, before the stabilization
+type recommendation struct {
+	time     time.Time
+	replicas int32
+}
+
+// scaleEvent replicas update made on the app, used to know the changes made during the period of the policies
+type scaleEvent struct {
+	time      time.Time
+	increment int32
+}
+
+// parseBehavior parses the behavior annotation, a YAML or JSON object
+func parseBehavior(key string, value string) (*ScalingBehavior, error) {
+	behavior := &ScalingBehavior{}
+
+	if err := yaml.Unmarshal([]byte(value), behavior); err != nil {
+		return nil, fmt.Errorf(invalidBehaviorError, key, Behavior, err)
+	}
+
+	for direction, rules := range map[string]*ScalingRules{"scaleUp": behavior.ScaleUp, "scaleDown": behavior.ScaleDown} {
+		if err := rules.validate(); err != nil {
+			return nil, fmt.Errorf(invalidBehaviorError, key, Behavior, direction+": "+err.Error())
+		}
+	}
+
+	return behavior, nil
+}
+
+func (rules *ScalingRules) validate() error {
+	if rules == nil {
+		return nil
+	}
+
+	if rules.StabilizationWindowSeconds < 0 || rules.StabilizationWindowSeconds > maxStabilizationWindowSeconds {
+		return fmt.Errorf("stabilizationWindowSeconds must be between 0 and %d", maxStabilizationWindowSeconds)
+	}
+
+	switch rules.SelectPolicy {
+	case "", MaxPolicySelect, MinPolicySelect, DisabledPolicySelect:
+	default:
+		return fmt.Errorf("selectPolicy must be one of %v", []string{MaxPolicySelect, MinPolicySelect, DisabledPolicySelect})
+	}
+
+	for _, policy := range rules.Policies {
+		if policy.Type != PodsScalingPolicy && policy.Type != PercentScalingPolicy {
+			return fmt.Errorf("policy type must be one of %v", []string{PodsScalingPolicy, PercentScalingPolicy})
+		}
+
+		if policy.Value <= 0 {
+			return fmt.Errorf("policy value must be greater than 0")
+		}
+
+		if policy.PeriodSeconds <= 0 || policy.PeriodSeconds > maxPolicyPeriodSeconds {
+			return fmt.Errorf("policy periodSeconds must be between 1 and %d", maxPolicyPeriodSeconds)
+		}
+	}
+
+	return nil
+}
+
+// window returns the stabilization window of the rules, 0 when they are not set
+func (rules *ScalingRules) window() time.Duration {
+	if rules == nil {
+		return 0
+	}
+	return time.Duration(rules.StabilizationWindowSeconds) * time.Second
+}
+
+// longestPeriod returns the longest period of the policies, 0 when they are not set
+func (rules *ScalingRules) longestPeriod() time.Duration {
+	var longest time.Duration
+
+	if rules != nil {
+		for _, policy := range rules.Policies {
+			if period := time.Duration(policy.PeriodSeconds) * time.Second; period > longest {
+				longest = period
+			}
+		}
+	}
+
+	return longest
+}
+
+// String describes the policies in the logs and the decisions (ex: Max of 4 Pods/60s, 100 Percent/60s)
+func (rules *ScalingRules) String() string {
+	var policies []string
+
+	for _, policy := range rules.Policies {
+		policies = append(policies, fmt.Sprintf("%d %s/%ds", policy.Value, policy.Type, policy.PeriodSeconds))
+	}
+
+	return rules.selectPolicy() + " of " + strings.Join(policies, ", ")
+}
+
+func (rules *ScalingRules) selectPolicy() string {
+	if len(rules.SelectPolicy) == 0 {
+		return MaxPolicySelect
+	}
+	return rules.SelectPolicy
+}
+
+// stabilize returns the change of replicas once stabilized, false when the change is cancelled.
+// A scale down uses the highest recommendation of its window, a scale up the lowest one of its window
+func (app *App) stabilize(consumers int32, scale int32, now time.Time) (int32, bool) {
+	upWindow, downWindow := app.behavior.ScaleUp.window(), app.behavior.ScaleDown.window()
+
+	// The recommendations older than the longest window are forgotten
+	longest := upWindow
+	if downWindow > longest {
+		longest = downWindow
+	}
+
+	recommendations := []recommendation{{time: now, replicas: consumers + scale}}
+	for _, previous := range app.recommendations {
+		if now.Sub(previous.time) < longest {
+			recommendations = append(recommendations, previous)
+		}
+	}
+	app.recommendations = recommendations
+
+	window, stabilized := downWindow, consumers+scale
+	if scale > 0 {
+		window = upWindow
+	}
+
+	for _, previous := range recommendations {
+		if now.Sub(previous.time) >= window {
+			continue
+		}
+
+		if scale < 0 {
+			stabilized = max(stabilized, previous.replicas)
+		} else {
+			stabilized = min(stabilized, previous.replicas)
+		}
+	}
+
+	if scale < 0 {
+		stabilized = min(stabilized, consumers)
+	} else {
+		stabilized = max(stabilized, consumers)
+	}
+
+	if stabilized == consumers && scale != 0 {
+		klog.Infof("%s recommendation of %d workers stabilized to %d (window: %s)", app.key, consumers+scale, stabilized, window)
+		app.decide(decisionStabilized, "%d workers recommended, stabilized to %d by the recommendations of the last %s", consumers+scale, stabilized, window)
+		return 0, false
+	}
+
+	return stabilized - consumers, true
+}
+
+// scaleUpLimit returns the workers that can be added on this tick and what limits them,
+// the policies of the behavior or the steps
+func (app *App) scaleUpLimit(now time.Time) (int32, string) {
+	var rules *ScalingRules
+	if app.behavior != nil {
+		rules = app.behavior.ScaleUp
+	}
+
+	if rules != nil && rules.SelectPolicy == DisabledPolicySelect {
+		return 0, "selectPolicy: " + DisabledPolicySelect
+	}
+
+	if rules == nil || len(rules.Policies) == 0 {
+		return app.steps, fmt.Sprintf("steps: %d", app.steps)
+	}
+
+	var limit int32
+	for i, policy := range rules.Policies {
+		// Replicas before the scale ups of the period
+		start := app.replicas - app.scaledDuring(policy.PeriodSeconds, now, 1)
+
+		allowed := start + policy.Value
+		if policy.Type == PercentScalingPolicy {
+			allowed = int32(math.Ceil(float64(start) * (1 + float64(policy.Value)/100)))
+		}
+
+		if i == 0 || (rules.selectPolicy() == MaxPolicySelect && allowed > limit) || (rules.selectPolicy() == MinPolicySelect && allowed < limit) {
+			limit = allowed
+		}
+	}
+
+	return max(min(limit, app.maxWorkers)-app.replicas, 0), "policies: " + rules.String()
+}
+
+// scaleDownLimit returns the workers that can be removed on this tick and what limits them,
+// the policies of the behavior or the steps
+func (app *App) scaleDownLimit(now time.Time) (int32, string) {
+	var rules *ScalingRules
+	if app.behavior != nil {
+		rules = app.behavior.ScaleDown
+	}
+
+	if rules != nil && rules.SelectPolicy == DisabledPolicySelect {
+		return 0, "selectPolicy: " + DisabledPolicySelect
+	}
+
+	if rules == nil || len(rules.Policies) == 0 {
+		return app.steps, fmt.Sprintf("steps: %d", app.steps)
+	}
+
+	var limit int32
+	for i, policy := range rules.Policies {
+		// Replicas before the scale downs of the period
+		start := app.replicas - app.scaledDuring(policy.PeriodSeconds, now, -1)
+
+		allowed := start - policy.Value
+		if policy.Type == PercentScalingPolicy {
+			allowed = int32(float64(start) * (1 - float64(policy.Value)/100))
+		}
+
+		if i == 0 || (rules.selectPolicy() == MaxPolicySelect && allowed < limit) || (rules.selectPolicy() == MinPolicySelect && allowed > limit) {
+			limit = allowed
+		}
+	}
+
+	return max(app.replicas-max(limit, app.minWorkers), 0), "policies: " + rules.String()
+}
+
+// scaledDuring returns the replicas added (direction 1) or removed (direction -1) during the last period
+func (app *App) scaledDuring(periodSeconds int32, now time.Time, direction int32) int32 {
+	var scaled int32
+	period := time.Duration(periodSeconds) * time.Second
+
+	for _, event := range app.scaleEvents {
+		if now.Sub(event.time) < period && event.increment*direction > 0 {
+			scaled += event.increment
+		}
+	}
+
+	return scaled
+}
+
+// recordScaleEvent keeps the replicas updates needed by the policies of the behavior
+func (app *App) recordScaleEvent(now time.Time, increment int32) {
+	if app.behavior == nil {
+		return
+	}
+
+	longest := app.behavior.ScaleUp.longestPeriod()
+	if period := app.behavior.ScaleDown.longestPeriod(); period > longest {
+		longest = period
+	}
+
+	events := []scaleEvent{{time: now, increment: increment}}
+	for _, event := range app.scaleEvents {
+		if now.Sub(event.time) < longest {
+			events = append(events, event)
+		}
+	}
+	app.scaleEvents = events
+}
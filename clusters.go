@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultCluster Cluster used by the apps without a cluster annotation, configured with the rmq_url, rmq_user and rmq_password flags
+	DefaultCluster = "default"
+
+	noDefaultClusterError = "no default cluster configured for backend %s, set the `%s` annotation"
+	unknownClusterError   = "cluster %s is not configured for backend %s"
+	invalidSourceError    = "workload: %s property `%s` is not valid (%s)"
+)
+
+// clustersConfig named RabbitMQ connections, read from the clusters_config file (YAML or JSON)
+type clustersConfig struct {
+	Clusters []clusterConfig `json:"clusters"`
+}
+
+// clusterConfig connection to a RabbitMQ cluster. The user and password can be read from files,
+// for example the keys of a Secret mounted as a volume
+type clusterConfig struct {
+	Name         string     `json:"name"`
+	URL          string     `json:"url"`
+	User         string     `json:"user,omitempty"`
+	UserFile     string     `json:"userFile,omitempty"`
+	Password     string     `json:"password,omitempty"`
+	PasswordFile string     `json:"passwordFile,omitempty"`
+	TLS          tlsOptions `json:"tls,omitempty"`
+}
+
+// queueSources sources of each backend, by cluster name
+type queueSources map[string]map[string]QueueSource
+
+// get returns the source of a cluster, the default cluster is used when the cluster is empty
+func (sources queueSources) get(backend string, cluster string) (QueueSource, error) {
+	clusters, ok := sources[backend]
+	if !ok {
+		return nil, fmt.Errorf(unknownBackendError, backend)
+	}
+
+	if len(cluster) == 0 {
+		cluster = DefaultCluster
+	}
+
+	source, ok := clusters[cluster]
+	if !ok && cluster == DefaultCluster {
+		return nil, fmt.Errorf(noDefaultClusterError, backend, Cluster)
+	} else if !ok {
+		return nil, fmt.Errorf(unknownClusterError, cluster, backend)
+	}
+
+	return source, nil
+}
+
+// check returns an error when a queue of the app uses a backend or a cluster that is not configured.
+// It's a configuration error, the app is rejected instead of failing on each tick
+func (sources queueSources) check(app *App) error {
+	for _, queue := range app.queues {
+		if _, ok := sources[queue.backend]; !ok {
+			return fmt.Errorf(invalidSourceError, app.key, Backend, fmt.Sprintf(unknownBackendError, queue.backend))
+		}
+
+		if _, err := sources.get(queue.backend, queue.cluster); err != nil {
+			return fmt.Errorf(invalidSourceError, app.key, Cluster, err)
+		}
+	}
+
+	return nil
+}
+
+// loadClusters reads the clusters config file
+func loadClusters(path string) ([]clusterConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &clustersConfig{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid clusters config %s (%s)", path, err)
+	}
+
+	return config.Clusters, nil
+}
+
+// newClusters creates the RabbitMQ connection of each cluster, the timeout bounds each request
+func newClusters(configs []clusterConfig, timeout time.Duration) (map[string]QueueSource, error) {
+	clusters := make(map[string]QueueSource)
+
+	for _, config := range configs {
+		if len(config.Name) == 0 {
+			return nil, fmt.Errorf("cluster %s has no name", config.URL)
+		}
+
+		if _, ok := clusters[config.Name]; ok {
+			return nil, fmt.Errorf("cluster %s is defined twice", config.Name)
+		}
+
+		user, err := readValue(config.User, config.UserFile)
+		if err != nil {
+			return nil, err
+		}
+
+		password, err := readValue(config.Password, config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := newHTTPClient(config.TLS, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %s", config.Name, err)
+		}
+
+		rmq, err := newRmq(config.URL, user, password, client)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %s", config.Name, err)
+		}
+
+		clusters[config.Name] = rmq
+	}
+
+	return clusters, nil
+}
+
+// readValue returns the value, or the content of the file when set
+func readValue(value string, file string) (string, error) {
+	if len(file) == 0 {
+		return value, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+const (
+	// CredentialsSecretType Type of the Secrets holding the credentials of an app, with the username and password keys
+	CredentialsSecretType = "kubernetes.io/basic-auth"
+
+	credentialsNotWatchedError = "credentials secret %s can't be used, the credentials secrets are not watched"
+	credentialsNotFoundError   = "credentials secret %s not found, or not a " + CredentialsSecretType + " secret with username and password"
+)
+
+// SecretsResource Secrets watched for the credentials of the apps
+var SecretsResource = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// credentialsSource a QueueSource that can be used with the credentials of an app
+type credentialsSource interface {
+	withCredentials(user string, password string) QueueSource
+}
+
+type credentials struct {
+	user     string
+	password string
+}
+
+// credentialsStore credentials of the watched Secrets, by namespace/name
+type credentialsStore struct {
+	mu      sync.RWMutex
+	secrets map[string]credentials
+}
+
+func newCredentialsStore() *credentialsStore {
+	return &credentialsStore{secrets: make(map[string]credentials)}
+}
+
+// handler keeps the credentials up to date with the Secrets, so they are rotated on the next tick
+func (s *credentialsStore) handler(key string, object *unstructured.Unstructured) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if object == nil {
+		delete(s.secrets, key)
+		return
+	}
+
+	user, userErr := secretValue(object, "username")
+	password, passwordErr := secretValue(object, "password")
+
+	if userErr != nil || passwordErr != nil {
+		klog.Infof("Secret %s has no valid username and password, ignoring it", key)
+		delete(s.secrets, key)
+		return
+	}
+
+	if _, ok := s.secrets[key]; ok {
+		klog.Infof("Rotating credentials of secret %s", key)
+	}
+
+	s.secrets[key] = credentials{user: user, password: password}
+}
+
+// get returns the credentials of a Secret (ex: namespace/name)
+func (s *credentialsStore) get(key string) (credentials, error) {
+	if s == nil {
+		return credentials{}, newSourceError(SourceAuthFailed, credentialsNotWatchedError, key)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	secret, ok := s.secrets[key]
+	if !ok {
+		return credentials{}, newSourceError(SourceAuthFailed, credentialsNotFoundError, key)
+	}
+
+	return secret, nil
+}
+
+func secretValue(object *unstructured.Unstructured, key string) (string, error) {
+	encoded, found, err := unstructured.NestedString(object.Object, "data", key)
+	if !found || err != nil {
+		return "", fmt.Errorf("missing key %s", key)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
@@ -2,42 +2,62 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"k8s.io/api/apps/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	cacheddiscovery "k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/scale"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
+// handler called with the object of a key, the object is nil when it has been deleted
+type handler func(key string, object *unstructured.Unstructured)
+
 type controller struct {
+	resource schema.GroupVersionResource
 	indexer  cache.Indexer
 	queue    workqueue.Interface
 	informer cache.Controller
-	hub      *Autoscaler
+	handler  handler
+}
+
+// clients used to watch and scale the workloads
+type clients struct {
+	kubernetes *kubernetes.Clientset
+	dynamic    dynamic.Interface
+	// requests dynamic client of the requests made outside of the informers, they must not exceed the app timeout
+	requests dynamic.Interface
+	mapper   meta.RESTMapper
+	scale    scale.ScalesGetter
 }
 
-func newController(queue workqueue.Interface, indexer cache.Indexer, informer cache.Controller, hub *Autoscaler) *controller {
+func newController(resource schema.GroupVersionResource, queue workqueue.Interface, indexer cache.Indexer, informer cache.Controller, handler handler) *controller {
 	return &controller{
+		resource: resource,
 		informer: informer,
 		indexer:  indexer,
 		queue:    queue,
-		hub:      hub,
+		handler:  handler,
 	}
 }
 
-func createClient(inCluster bool) (*kubernetes.Clientset, error) {
+func createClient(inCluster bool, scaleTimeout time.Duration) (*clients, error) {
 	var config *rest.Config
 	var err error
 	if inCluster {
@@ -53,12 +73,42 @@ func createClient(inCluster bool) (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, err
 	}
-	return client, nil
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	// The scale requests are made while scaling an app, they must not exceed its timeout
+	scaleConfig := rest.CopyConfig(config)
+	scaleConfig.Timeout = scaleTimeout
+	scaleDiscovery, err := kubernetes.NewForConfig(scaleConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Resolve the scale subresource of any resource (built-in or custom) through the discovery API.
+	// The mapper is also used by the watch goroutine to resolve the RabbitScaler targets, its discovery must not hang
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cacheddiscovery.NewMemCacheClient(scaleDiscovery.Discovery()))
+	scaleClient, err := scale.NewForConfig(scaleConfig, mapper, dynamic.LegacyAPIPathResolverFunc, scale.NewDiscoveryScaleKindResolver(client.Discovery()))
+	if err != nil {
+		return nil, err
+	}
+	// The RabbitScalers status is written while scaling an app and their targets are resolved by the watch goroutine,
+	// the watches of the informers keep the client without timeout
+	requestsClient, err := dynamic.NewForConfig(scaleConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &clients{
+		kubernetes: client,
+		dynamic:    dynamicClient,
+		requests:   requestsClient,
+		mapper:     mapper,
+		scale:      scaleClient,
+	}, nil
 }
 
-func discover(ctx context.Context, hub *Autoscaler, inCluster bool, namespacesToWatch string) (*kubernetes.Clientset, error) {
+func discover(ctx context.Context, hub *Autoscaler, inCluster bool, scaleTimeout time.Duration, namespacesToWatch string, resourcesToWatch []schema.GroupVersionResource, watchRabbitScalers bool, credentials *credentialsStore) (*clients, error) {
 	// create the clientset
-	client, err := createClient(inCluster)
+	kubeClients, err := createClient(inCluster, scaleTimeout)
 
 	if err != nil {
 		return nil, err
@@ -66,7 +116,7 @@ func discover(ctx context.Context, hub *Autoscaler, inCluster bool, namespacesTo
 
 	namespaceToWatch := getNamespacesSet(namespacesToWatch)
 
-	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{})
+	namespaces, err := kubeClients.kubernetes.CoreV1().Namespaces().List(metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -82,45 +132,67 @@ func discover(ctx context.Context, hub *Autoscaler, inCluster bool, namespacesTo
 			}
 		}
 
-		listWatch := createWatch(client, namespace.Name)
-		queue := workqueue.New()
-
-		indexer, informer := cache.NewIndexerInformer(listWatch, &v1beta1.Deployment{}, 0, cache.ResourceEventHandlerFuncs{
-			AddFunc: func(o interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(o)
-				if err == nil {
-					queue.Add(key)
-				}
-			},
-			DeleteFunc: func(o interface{}) {
-				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(o)
-				if err == nil {
-					queue.Add(key)
-				}
-			},
-			UpdateFunc: func(p, o interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(o)
-				if err == nil {
-					queue.Add(key)
-				}
-			},
-		}, cache.Indexers{})
-
-		controller := newController(queue, indexer, informer, hub)
-
-		go controller.run(ctx)
-	}
-
-	return client, nil
+		for _, resource := range resourcesToWatch {
+			watchResource(ctx, kubeClients.dynamic, resource, namespace.Name, hub.workloadHandler(resource))
+		}
+
+		if watchRabbitScalers {
+			watchResource(ctx, kubeClients.dynamic, RabbitScalersResource, namespace.Name, hub.rabbitScalerHandler)
+		}
+
+		if credentials != nil {
+			// Only the credentials secrets are watched, the other Secrets of the namespace are never read
+			watchFilteredResource(ctx, kubeClients.dynamic, SecretsResource, namespace.Name, "type="+CredentialsSecretType, credentials.handler)
+		}
+	}
+
+	return kubeClients, nil
+}
+
+func watchResource(ctx context.Context, client dynamic.Interface, resource schema.GroupVersionResource, namespace string, handler handler) {
+	watchFilteredResource(ctx, client, resource, namespace, "", handler)
 }
 
-func createWatch(client *kubernetes.Clientset, namespace string) *cache.ListWatch {
+// watchFilteredResource watches the objects of the namespace matching the field selector, all of them when empty
+func watchFilteredResource(ctx context.Context, client dynamic.Interface, resource schema.GroupVersionResource, namespace string, fieldSelector string, handler handler) {
+	listWatch := createWatch(client, resource, namespace, fieldSelector)
+	queue := workqueue.New()
+
+	indexer, informer := cache.NewIndexerInformer(listWatch, &unstructured.Unstructured{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(o)
+			if err == nil {
+				queue.Add(key)
+			}
+		},
+		DeleteFunc: func(o interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(o)
+			if err == nil {
+				queue.Add(key)
+			}
+		},
+		UpdateFunc: func(p, o interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(o)
+			if err == nil {
+				queue.Add(key)
+			}
+		},
+	}, cache.Indexers{})
+
+	controller := newController(resource, queue, indexer, informer, handler)
+
+	go controller.run(ctx)
+}
+
+func createWatch(client dynamic.Interface, resource schema.GroupVersionResource, namespace string, fieldSelector string) *cache.ListWatch {
 	return &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return client.AppsV1beta1().Deployments(namespace).List(options)
+			options.FieldSelector = fieldSelector
+			return client.Resource(resource).Namespace(namespace).List(options)
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return client.AppsV1beta1().Deployments(namespace).Watch(options)
+			options.FieldSelector = fieldSelector
+			return client.Resource(resource).Namespace(namespace).Watch(options)
 		},
 	}
 }
@@ -136,7 +208,7 @@ func getNamespacesSet(namespacesToWatch string) map[string]bool {
 func (c *controller) run(ctx context.Context) {
 	// Let the workers stop when we are done
 	defer c.queue.ShutDown()
-	klog.Info("Starting Service controller")
+	klog.Infof("Starting %s controller", c.resource.Resource)
 
 	go c.informer.Run(ctx.Done())
 
@@ -149,7 +221,7 @@ func (c *controller) run(ctx context.Context) {
 	go wait.Until(c.runWorker, time.Second, ctx.Done())
 
 	<-ctx.Done()
-	klog.Info("Stopping Service controller")
+	klog.Infof("Stopping %s controller", c.resource.Resource)
 }
 
 func (c *controller) runWorker() {
@@ -171,16 +243,17 @@ func (c *controller) processNextItem() bool {
 		return true
 	}
 
+	if !exists {
+		klog.Infof("%s %s does not exist anymore", c.resource.Resource, key)
+		c.handler(key.(string), nil)
+		return true
+	}
+
 	if obj == nil {
 		klog.Errorf("Object is nil %s", key)
 		return true
 	}
 
-	if !exists {
-		fmt.Printf("Deployment %s does not exist anymore\n", key)
-		c.hub.delete <- obj.(*v1beta1.Deployment)
-	} else {
-		c.hub.add <- obj.(*v1beta1.Deployment)
-	}
+	c.handler(key.(string), obj.(*unstructured.Unstructured))
 	return true
 }
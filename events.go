@@ -0,0 +1,56 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "k8s-rmq-autoscaler"
+
+	// ScaledUpReason Event reason used when the replicas of a deployment are increased
+	ScaledUpReason = "ScaledUp"
+	// ScaledDownReason Event reason used when the replicas of a deployment are decreased
+	ScaledDownReason = "ScaledDown"
+	// ScaleFailedReason Event reason used when the replicas of a deployment could not be updated
+	ScaleFailedReason = "ScaleFailed"
+	// InvalidAnnotationsReason Event reason used when the autoscaler annotations can't be parsed
+	InvalidAnnotationsReason = "InvalidAnnotations"
+	// QueueFetchFailedReason Event reason used when the queue information can't be fetched from RabbitMQ
+	QueueFetchFailedReason = "QueueFetchFailed"
+	// QueueNotFoundReason Event reason used when the queue or its vhost doesn't exist
+	QueueNotFoundReason = "QueueNotFound"
+	// QueueAuthFailedReason Event reason used when the credentials used to read the queue are refused
+	QueueAuthFailedReason = "QueueAuthFailed"
+	// DryRunReason Event reason used when the replicas of a deployment in dry run would have been updated
+	DryRunReason = "DryRun"
+)
+
+// newEventRecorder creates a recorder that post events on the watched deployments
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// queueErrorReason returns the event reason of an error while fetching a queue
+func queueErrorReason(err error) string {
+	switch errorKind(err) {
+	case SourceNotFound:
+		return QueueNotFoundReason
+	case SourceAuthFailed:
+		return QueueAuthFailedReason
+	}
+	return QueueFetchFailedReason
+}
+
+func scaleReason(increment int32) string {
+	if increment < 0 {
+		return ScaledDownReason
+	}
+	return ScaledUpReason
+}
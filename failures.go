@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/scale"
+	"k8s.io/klog"
+)
+
+const (
+	// FailurePolicyHold The replicas are kept while the queues can't be read
+	FailurePolicyHold = "hold"
+	// FailurePolicyFallback The workload is scaled to the fallback-replicas after failure-threshold failures
+	FailurePolicyFallback = "fallback"
+	// FailurePolicyMin The workload is scaled to the min-workers after failure-threshold failures
+	FailurePolicyMin = "min"
+
+	decisionFailure = "failure"
+)
+
+// failurePolicyReplicas returns the replicas set by the failure policy, false when the replicas are kept
+func (app *App) failurePolicyReplicas() (int32, bool) {
+	if app.failures < app.failureThreshold {
+		return 0, false
+	}
+
+	switch app.failurePolicy {
+	case FailurePolicyFallback:
+		return app.fallbackReplicas, true
+	case FailurePolicyMin:
+		return app.minWorkers, true
+	}
+
+	return 0, false
+}
+
+// failed applies the failure policy of an app whose queues can't be read
+func (a *Autoscaler) failed(ctx context.Context, app *App, scaler scale.ScalesGetter) error {
+	replicas, ok := app.failurePolicyReplicas()
+	app.decide(decisionFailure, "queues can't be read since %d ticks (failure policy: %s, threshold: %d)", app.failures, app.failurePolicy, app.failureThreshold)
+
+	if !ok || replicas == app.replicas {
+		klog.Infof("%s queues can't be read since %d ticks, keeping %d replicas (failure policy: %s)", app.key, app.failures, app.replicas, app.failurePolicy)
+		observeDecision(app, app.desiredReplicas)
+		return nil
+	}
+
+	app.desiredReplicas = replicas
+	observeDecision(app, app.desiredReplicas)
+	klog.Warningf("%s queues can't be read since %d ticks, scaling from %d to %d replicas (failure policy: %s)", app.key, app.failures, app.replicas, replicas, app.failurePolicy)
+	return a.scaleTo(ctx, app, scaler, replicas, fmt.Sprintf("failure policy %s after %d failures", app.failurePolicy, app.failures))
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// LeasesResource Resource of the coordination/v1 Leases, served since Kubernetes 1.14 (v1beta1 was removed in 1.22).
+// The vendored API has no coordination/v1 types, the Leases are read through the dynamic client into the v1beta1 types, they share the same schema
+var LeasesResource = schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1", Resource: "leases"}
+
+// leaderElectionConfig settings used to elect the autoscaler that will be allowed to scale
+type leaderElectionConfig struct {
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// leaseLock resourcelock.Interface implementation backed by a coordination/v1 Lease
+type leaseLock struct {
+	leaseMeta metav1.ObjectMeta
+	client    dynamic.Interface
+	identity  string
+	// mu guards the lease, a tryAcquireOrRenew abandoned by a timed out renew may still be running
+	mu    sync.Mutex
+	lease *coordinationv1beta1.Lease
+}
+
+// runLeaderElection blocks and calls run each time the current instance becomes the leader.
+// A run never overlaps the previous one, the leadership is acquired again only once the previous run returned
+func runLeaderElection(ctx context.Context, client dynamic.Interface, config leaderElectionConfig, run func(ctx context.Context)) error {
+	// Held while run is running, the elector starts OnStartedLeading in a goroutine it doesn't wait for
+	var running sync.Mutex
+
+	callbacks := leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			running.Lock()
+			defer running.Unlock()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			klog.Infof("%s is now the leader, starting the autoscaler", config.identity)
+			run(ctx)
+		},
+		OnStoppedLeading: func() {
+			klog.Infof("%s is not the leader anymore", config.identity)
+		},
+		OnNewLeader: func(identity string) {
+			if identity != config.identity {
+				klog.Infof("%s is the current leader, waiting", identity)
+			}
+		},
+	}
+
+	// Run returns when the leadership is lost, try to acquire it again until the context is canceled
+	for {
+		// A renew that timed out leaves its tryAcquireOrRenew running on the elector and its lock,
+		// each pass uses its own so that it never races with the next acquire
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:          newLeaseLock(client, config),
+			Name:          config.name,
+			LeaseDuration: config.leaseDuration,
+			RenewDeadline: config.renewDeadline,
+			RetryPeriod:   config.retryPeriod,
+			Callbacks:     callbacks,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		elector.Run(ctx)
+
+		// Wait for the run of the lost leadership to return, its tick may still be scaling
+		running.Lock()
+		running.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+func newLeaseLock(client dynamic.Interface, config leaderElectionConfig) *leaseLock {
+	return &leaseLock{
+		leaseMeta: metav1.ObjectMeta{
+			Namespace: config.namespace,
+			Name:      config.name,
+		},
+		client:   client,
+		identity: config.identity,
+	}
+}
+
+// Get returns the election record from the Lease spec
+func (ll *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	object, err := ll.leases().Get(ll.leaseMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if ll.lease, err = newLease(object); err != nil {
+		return nil, err
+	}
+	return leaseSpecToRecord(&ll.lease.Spec), nil
+}
+
+// Create attempts to create a Lease holding the election record
+func (ll *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	object, err := leaseObject(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ll.leaseMeta.Name,
+			Namespace: ll.leaseMeta.Namespace,
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+	if err != nil {
+		return err
+	}
+
+	if object, err = ll.leases().Create(object, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	ll.lease, err = newLease(object)
+	return err
+}
+
+// Update will update the existing Lease with the election record
+func (ll *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	if ll.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	ll.lease.Spec = recordToLeaseSpec(&ler)
+
+	object, err := leaseObject(ll.lease)
+	if err != nil {
+		return err
+	}
+
+	if object, err = ll.leases().Update(object, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	ll.lease, err = newLease(object)
+	return err
+}
+
+func (ll *leaseLock) leases() dynamic.ResourceInterface {
+	return ll.client.Resource(LeasesResource).Namespace(ll.leaseMeta.Namespace)
+}
+
+// RecordEvent logs the leader election transitions
+func (ll *leaseLock) RecordEvent(s string) {
+	klog.Infof("%s %s (lease %s)", ll.identity, s, ll.Describe())
+}
+
+// Identity returns the identity of the current instance
+func (ll *leaseLock) Identity() string {
+	return ll.identity
+}
+
+// Describe returns the namespace/name of the Lease
+func (ll *leaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", ll.leaseMeta.Namespace, ll.leaseMeta.Name)
+}
+
+func newLease(object *unstructured.Unstructured) (*coordinationv1beta1.Lease, error) {
+	lease := &coordinationv1beta1.Lease{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), lease)
+	return lease, err
+}
+
+// leaseObject converts the Lease to an unstructured coordination/v1 Lease
+func leaseObject(lease *coordinationv1beta1.Lease) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &unstructured.Unstructured{Object: content}
+	object.SetAPIVersion(LeasesResource.GroupVersion().String())
+	object.SetKind("Lease")
+	return object, nil
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	record := &resourcelock.LeaderElectionRecord{}
+
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = metav1.NewTime(spec.AcquireTime.Time)
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = metav1.NewTime(spec.RenewTime.Time)
+	}
+
+	return record
+}
+
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holderIdentity := ler.HolderIdentity
+	acquireTime := metav1.NewMicroTime(ler.AcquireTime.Time)
+	renewTime := metav1.NewMicroTime(ler.RenewTime.Time)
+
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holderIdentity,
+		LeaseDurationSeconds: int32Ptr(int32(ler.LeaseDurationSeconds)),
+		AcquireTime:          &acquireTime,
+		RenewTime:            &renewTime,
+		LeaseTransitions:     int32Ptr(int32(ler.LeaderTransitions)),
+	}
+}
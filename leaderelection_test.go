@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestLeaseSpecRecord(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	record := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       "autoscaler-0",
+		LeaseDurationSeconds: 15,
+		AcquireTime:          metav1.NewTime(now.Add(-time.Minute)),
+		RenewTime:            metav1.NewTime(now),
+		LeaderTransitions:    3,
+	}
+
+	spec := recordToLeaseSpec(&record)
+
+	if *spec.HolderIdentity != "autoscaler-0" || *spec.LeaseDurationSeconds != 15 || *spec.LeaseTransitions != 3 {
+		t.Error("Unexpected lease spec ", spec)
+	}
+
+	if roundTrip := leaseSpecToRecord(&spec); *roundTrip != record {
+		t.Error("Expected ", record, ", got ", *roundTrip)
+	}
+
+	// An empty spec is an empty record
+	if empty := leaseSpecToRecord(&coordinationv1beta1.LeaseSpec{}); *empty != (resourcelock.LeaderElectionRecord{}) {
+		t.Error("Expected an empty record, got ", empty)
+	}
+}
+
+func TestLeaseLock(t *testing.T) {
+	client := &fakeObjects{objects: make(map[string]*unstructured.Unstructured)}
+	lock := &leaseLock{
+		leaseMeta: metav1.ObjectMeta{Namespace: "k8s-rmq-autoscaler", Name: "k8s-rmq-autoscaler"},
+		client:    client,
+		identity:  "autoscaler-0",
+	}
+
+	if _, err := lock.Get(); !errors.IsNotFound(err) {
+		t.Error("Expected a not found error, got ", err)
+	}
+
+	if err := lock.Update(resourcelock.LeaderElectionRecord{}); err == nil {
+		t.Error("Update before get or create should fail")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	record := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       "autoscaler-0",
+		LeaseDurationSeconds: 15,
+		AcquireTime:          metav1.NewTime(now),
+		RenewTime:            metav1.NewTime(now),
+	}
+
+	if err := lock.Create(record); err != nil {
+		t.Fatal(err)
+	}
+
+	lease := client.objects["k8s-rmq-autoscaler"]
+
+	if client.resource != LeasesResource || lease.GetAPIVersion() != "coordination.k8s.io/v1" || lease.GetKind() != "Lease" || lease.GetNamespace() != "k8s-rmq-autoscaler" {
+		t.Error("Expected a coordination.k8s.io/v1 Lease, got ", client.resource, lease.Object)
+	}
+
+	if holder, _, _ := unstructured.NestedString(lease.Object, "spec", "holderIdentity"); holder != "autoscaler-0" {
+		t.Error("Expected autoscaler-0, got ", holder)
+	}
+
+	record.RenewTime = metav1.NewTime(now.Add(2 * time.Second))
+
+	if err := lock.Update(record); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := lock.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *got != record || client.objects["k8s-rmq-autoscaler"].GetResourceVersion() != "2" {
+		t.Error("Expected ", record, ", got ", *got)
+	}
+
+	// Another replica renewed the Lease since the last get
+	other := &leaseLock{leaseMeta: lock.leaseMeta, client: client, identity: "autoscaler-1"}
+	other.Get()
+	other.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "autoscaler-1"})
+
+	if err := lock.Update(record); !errors.IsConflict(err) {
+		t.Error("Expected a conflict, got ", err)
+	}
+}
+
+func TestLeaderElectionRunsDontOverlap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &fakeObjects{objects: make(map[string]*unstructured.Unstructured)}
+	config := leaderElectionConfig{
+		namespace:     "k8s-rmq-autoscaler",
+		name:          "k8s-rmq-autoscaler",
+		identity:      "autoscaler-0",
+		leaseDuration: 300 * time.Millisecond,
+		renewDeadline: 200 * time.Millisecond,
+		retryPeriod:   50 * time.Millisecond,
+	}
+
+	var running, runs, overlaps int32
+
+	done := make(chan error)
+	go func() {
+		done <- runLeaderElection(ctx, client, config, func(runCtx context.Context) {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			defer atomic.AddInt32(&running, -1)
+
+			// Another replica takes the Lease, the renew fails
+			other := &leaseLock{leaseMeta: metav1.ObjectMeta{Namespace: config.namespace, Name: config.name}, client: client, identity: "autoscaler-1"}
+			if _, err := other.Get(); err != nil {
+				t.Error(err)
+			}
+			now := metav1.Now()
+			other.Update(resourcelock.LeaderElectionRecord{HolderIdentity: "autoscaler-1", LeaseDurationSeconds: 1, AcquireTime: now, RenewTime: now})
+
+			// The tick still scales after the leadership is lost
+			<-runCtx.Done()
+			time.Sleep(500 * time.Millisecond)
+
+			// Stopped once the leadership is lost, client-go v10 doesn't wait for its renew when canceled while leading
+			if atomic.AddInt32(&runs, 1) > 1 {
+				cancel()
+			}
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The leadership was not acquired again")
+	}
+
+	if atomic.LoadInt32(&runs) != 2 || atomic.LoadInt32(&overlaps) != 0 {
+		t.Errorf("Expected 2 runs without overlap, got %d runs and %d overlaps", runs, overlaps)
+	}
+}
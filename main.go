@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/namsral/flag"
-	"k8s.io/api/apps/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog"
 )
 
@@ -14,33 +15,165 @@ func main() {
 
 	namespaces := flag.String("namespaces", "", "namespaces to watch separated by commas")
 	inCluster := flag.Bool("in_cluster", true, "Boolean that indicate if your are inside the cluster or not")
+	resources := flag.String("resources", DefaultResources, "resources with a /scale subresource to watch separated by commas, formatted as resource.version.group")
+	rabbitScalers := flag.Bool("rabbit_scalers", false, "Boolean that enable the watch of the RabbitScaler custom resources")
 	rmqURL := flag.String("rmq_url", "", "RMQ Host URL")
 	rmqUser := flag.String("rmq_user", "", "RMQ Username used for authentication with the RabbitMQ API")
 	rmqPassword := flag.String("rmq_password", "", "RMQ Password used for authentication with the RabbitMQ API")
+	rmqCAFile := flag.String("rmq_ca_file", "", "PEM bundle of the CAs trusted to sign the certificate of the RabbitMQ API (default: system CAs)")
+	rmqCertFile := flag.String("rmq_cert_file", "", "Client certificate used for mutual TLS with the RabbitMQ API")
+	rmqKeyFile := flag.String("rmq_key_file", "", "Client key used for mutual TLS with the RabbitMQ API")
+	rmqServerName := flag.String("rmq_server_name", "", "Name checked in the certificate of the RabbitMQ API instead of the host of the URL")
+	rmqInsecureSkipVerify := flag.Bool("rmq_insecure_skip_verify", false, "Boolean that disable the verification of the certificate of the RabbitMQ API")
+	rmqTimeout := flag.Duration("rmq_timeout", 5*time.Second, "Timeout of each request to the RabbitMQ API, 0 to only rely on app_timeout")
+	clustersConfig := flag.String("clusters_config", "", "File (YAML or JSON) defining named RabbitMQ clusters, selected with the cluster annotation")
+	credentialsSecrets := flag.Bool("credentials_secrets", false, "Boolean that enable the watch of the kubernetes.io/basic-auth Secrets used by the credentials-secret annotation")
 	loopTick := flag.Int("tick", 10, "Seconds between checks for autoscaling scale")
+	workers := flag.Int("workers", 5, "Number of apps scaled concurrently")
+	appTimeout := flag.Duration("app_timeout", 10*time.Second, "Timeout of the listing of each vhost, and of the Kubernetes calls made to scale an app or write the status of its RabbitScaler")
+	snapshotMaxAge := flag.Duration("snapshot_max_age", 0, "How long the last queues listed from RabbitMQ can be used when RabbitMQ can't be reached, 0 to disable")
+	dryRun := flag.Bool("dry_run", false, "Boolean that enable the dry run, the scaling decisions are only recorded and the replicas are never updated")
+	leaderElect := flag.Bool("leader_elect", false, "Boolean that enable the leader election, needed when running more than one replica")
+	leaderElectNamespace := flag.String("leader_elect_namespace", "k8s-rmq-autoscaler", "Namespace of the Lease used for the leader election")
+	leaderElectName := flag.String("leader_elect_name", "k8s-rmq-autoscaler", "Name of the Lease used for the leader election")
+	leaderElectIdentity := flag.String("leader_elect_identity", "", "Identity used for the leader election (default: hostname)")
+	leaderElectLeaseDuration := flag.Duration("leader_elect_lease_duration", 15*time.Second, "Duration that standbys will wait before trying to acquire the leadership")
+	leaderElectRenewDeadline := flag.Duration("leader_elect_renew_deadline", 10*time.Second, "Duration that the leader will retry refreshing the leadership before giving up")
+	leaderElectRetryPeriod := flag.Duration("leader_elect_retry_period", 2*time.Second, "Duration between each leader election try")
+	metricsAddress := flag.String("metrics_address", ":9090", "Address where the prometheus metrics are exposed, empty to disable")
+	adminAddress := flag.String("admin_address", "", "Address where the admin API is served, empty to disable")
+	adminToken := flag.String("admin_token", "", "Bearer token required to pause or pin an app through the admin API, empty to disable them")
+	webhookAddress := flag.String("webhook_address", "", "Address where the validating admission webhook is served, empty to disable")
+	webhookCertFile := flag.String("webhook_cert_file", "", "TLS certificate file of the validating admission webhook")
+	webhookKeyFile := flag.String("webhook_key_file", "", "TLS key file of the validating admission webhook")
 	flag.Parse()
 
-	rmq, err := newRmq(*rmqURL, *rmqUser, *rmqPassword)
+	var clusters []clusterConfig
+
+	if len(*clustersConfig) > 0 {
+		var err error
+		if clusters, err = loadClusters(*clustersConfig); err != nil {
+			klog.Error(err)
+			os.Exit(128)
+		}
+	}
+
+	// The flags define the default cluster, they are optional when other clusters are configured
+	if len(clusters) == 0 || len(*rmqURL) > 0 {
+		clusters = append(clusters, clusterConfig{
+			Name:     DefaultCluster,
+			URL:      *rmqURL,
+			User:     *rmqUser,
+			Password: *rmqPassword,
+			TLS: tlsOptions{
+				CAFile:             *rmqCAFile,
+				CertFile:           *rmqCertFile,
+				KeyFile:            *rmqKeyFile,
+				ServerName:         *rmqServerName,
+				InsecureSkipVerify: *rmqInsecureSkipVerify,
+			},
+		})
+	}
+
+	rabbitmqClusters, err := newClusters(clusters, *rmqTimeout)
 
 	if err != nil {
 		klog.Error(err)
 		os.Exit(128)
 	}
 
+	var credentials *credentialsStore
+
+	if *credentialsSecrets {
+		credentials = newCredentialsStore()
+	}
+
+	snapshots := newSnapshotter(queueSources{DefaultBackend: rabbitmqClusters}, *snapshotMaxAge)
+	snapshots.credentials = credentials
+	snapshots.workers, snapshots.timeout = *workers, *appTimeout
+
 	hub := &Autoscaler{
-		rmq:    rmq,
-		apps:   make(map[string]*App),
-		add:    make(chan *v1beta1.Deployment),
-		delete: make(chan *v1beta1.Deployment),
+		snapshots:         snapshots,
+		workers:           *workers,
+		appTimeout:        *appTimeout,
+		dryRun:            *dryRun,
+		adminToken:        *adminToken,
+		apps:              make(map[string]*App),
+		scalers:           make(map[string]*RabbitScaler),
+		scalerTargets:     make(map[string]string),
+		unresolvedScalers: make(map[string]*RabbitScaler),
+		validityUpdates:   make(chan struct{}, 1),
+		add:               make(chan *workload),
+		delete:            make(chan *workload),
+		addScaler:         make(chan *RabbitScaler),
+		deleteScaler:      make(chan *RabbitScaler),
 	}
 
-	k8sClient, err := discover(ctx, hub, *inCluster, *namespaces)
+	resourcesToWatch, err := parseResources(*resources)
 
 	if err != nil {
 		klog.Error(err)
 		os.Exit(128)
 	}
 
-	go hub.Run(ctx, k8sClient, *loopTick)
-	<-ctx.Done()
+	hub.resources = make(map[schema.GroupVersionResource]bool)
+	for _, resource := range resourcesToWatch {
+		hub.resources[resource] = true
+	}
+
+	k8sClients, err := discover(ctx, hub, *inCluster, *appTimeout, *namespaces, resourcesToWatch, *rabbitScalers, credentials)
+
+	if err != nil {
+		klog.Error(err)
+		os.Exit(128)
+	}
+
+	hub.clients = k8sClients
+	hub.recorder = newEventRecorder(k8sClients.kubernetes)
+	go hub.Watch(ctx)
+
+	if len(*metricsAddress) > 0 {
+		go serveMetrics(*metricsAddress)
+	}
+
+	if len(*adminAddress) > 0 {
+		go serveAdmin(*adminAddress, hub)
+	}
+
+	if len(*webhookAddress) > 0 {
+		go serveWebhook(*webhookAddress, *webhookCertFile, *webhookKeyFile, snapshots.sources)
+	}
+
+	if !*leaderElect {
+		go hub.Run(ctx, k8sClients.scale, *loopTick)
+		<-ctx.Done()
+		return
+	}
+
+	identity := *leaderElectIdentity
+
+	if len(identity) == 0 {
+		identity, err = os.Hostname()
+
+		if err != nil {
+			klog.Error(err)
+			os.Exit(128)
+		}
+	}
+
+	err = runLeaderElection(ctx, k8sClients.dynamic, leaderElectionConfig{
+		namespace:     *leaderElectNamespace,
+		name:          *leaderElectName,
+		identity:      identity,
+		leaseDuration: *leaderElectLeaseDuration,
+		renewDeadline: *leaderElectRenewDeadline,
+		retryPeriod:   *leaderElectRetryPeriod,
+	}, func(ctx context.Context) {
+		hub.Run(ctx, k8sClients.scale, *loopTick)
+	})
+
+	if err != nil {
+		klog.Error(err)
+		os.Exit(128)
+	}
 }
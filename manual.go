@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	decisionPaused = "paused"
+	decisionPinned = "pinned"
+)
+
+// manualSpecFields fields of the RabbitScaler spec matching the pause and pin annotations
+var manualSpecFields = map[string]string{
+	Paused:      "paused",
+	PinReplicas: "pinReplicas",
+	PinUntil:    "pinUntil",
+}
+
+// isManual returns true when the replicas of the app are paused or pinned
+func (app *App) isManual(now time.Time) bool {
+	_, _, pinned := app.pin(now)
+	return app.paused || pinned
+}
+
+// pin returns the replicas pinned until a date, false when the app is not pinned or the pin expired
+func (app *App) pin(now time.Time) (int32, time.Time, bool) {
+	if app.pinReplicas != nil && now.Before(app.pinUntil) {
+		return *app.pinReplicas, app.pinUntil, true
+	}
+
+	return 0, time.Time{}, false
+}
+
+// manualDecision returns the replicas set by the pause or the pin of the app, false when the autoscaler decides
+func (app *App) manualDecision(now time.Time) (int32, bool) {
+	if app.paused {
+		klog.Infof("%s is paused, keeping %d replicas", app.key, app.replicas)
+		app.decide(decisionPaused, "paused by the %s", app.manualSource())
+		return app.replicas, true
+	}
+
+	if replicas, until, ok := app.pin(now); ok {
+		klog.Infof("%s is pinned to %d replicas until %s", app.key, replicas, until)
+		app.decide(decisionPinned, "pinned to %d replicas until %s by the %s", replicas, until.Format(time.RFC3339), app.manualSource())
+		return replicas, true
+	}
+
+	return 0, false
+}
+
+func (app *App) manualSource() string {
+	if app.scaler != nil {
+		return "RabbitScaler spec"
+	}
+	return "annotations"
+}
+
+// patchManual persists the pause or pin of an app, in the annotations of its workload or in the spec of its RabbitScaler,
+// so every replica of the autoscaler applies it. A nil value removes the annotation. Returns false when the app doesn't exist
+func (a *Autoscaler) patchManual(key string, values map[string]interface{}) (interface{}, bool, error) {
+	a.mu.Lock()
+	app, ok := a.apps[key]
+	a.mu.Unlock()
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	resource, namespace, name := app.ref.resource, app.ref.namespace, app.ref.name
+	var patch map[string]interface{}
+
+	if app.scaler != nil {
+		spec := make(map[string]interface{})
+		for annotation, value := range values {
+			spec[manualSpecFields[annotation]] = value
+		}
+
+		resource, namespace, name = RabbitScalersResource, app.scaler.Namespace, app.scaler.Name
+		patch = map[string]interface{}{"spec": spec}
+	} else {
+		annotations := make(map[string]interface{})
+		for annotation, value := range values {
+			if value != nil {
+				value = annotationValue(value)
+			}
+			annotations[AnnotationPrefix+annotation] = value
+		}
+
+		patch = map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, true, err
+	}
+
+	_, err = a.clients.dynamic.Resource(resource).Namespace(namespace).Patch(name, types.MergePatchType, data, metav1.UpdateOptions{})
+	return patch, true, err
+}
+
+func annotationValue(value interface{}) string {
+	switch value := value.(type) {
+	case bool:
+		return strconv.FormatBool(value)
+	case int32:
+		return strconv.FormatInt(int64(value), 10)
+	default:
+		return value.(string)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "k8s_rmq_autoscaler"
+
+var (
+	decisions = []string{
+		decisionUp,
+		decisionDown,
+		decisionNone,
+		decisionUnstable,
+		decisionCoolDown,
+		decisionSafeUnscaleBlocked,
+		decisionFailure,
+		decisionPaused,
+		decisionPinned,
+		decisionStabilized,
+	}
+
+	queueMessagesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_messages",
+		Help:      "Number of messages in the queues watched by the app",
+	}, []string{"app"})
+	queueConsumersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_consumers",
+		Help:      "Number of consumers of the queues watched by the app, the lowest one with several queues",
+	}, []string{"app"})
+	queueRateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_rate",
+		Help:      "Messages per second going through the queues watched by the app, by kind (publish, deliver_get, ack)",
+	}, []string{"app", "kind"})
+	appQueueMessagesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "app_queue_messages",
+		Help:      "Number of messages in each queue consumed by the app",
+	}, []string{"app", "queue"})
+	appQueueWorkersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "app_queue_needed_workers",
+		Help:      "Workers needed by each queue consumed by the app, before the aggregation",
+	}, []string{"app", "queue"})
+	replicasGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "replicas",
+		Help:      "Current replicas of the app",
+	}, []string{"app"})
+	desiredReplicasGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "desired_replicas",
+		Help:      "Replicas wanted by the last scale decision of the app",
+	}, []string{"app"})
+	minWorkersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "min_workers",
+		Help:      "Minimum amount of workers of the app",
+	}, []string{"app"})
+	maxWorkersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "max_workers",
+		Help:      "Maximum amount of workers of the app",
+	}, []string{"app"})
+	offsetGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "offset",
+		Help:      "Workers added to the ones needed by the queues of the app",
+	}, []string{"app"})
+	scheduleWindowGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "schedule_window",
+		Help:      "Schedule windows of the app, the window whose limits are used is set to 1",
+	}, []string{"app", "window"})
+	lastDecisionGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_decision",
+		Help:      "Last scale decision of the app, the current decision is set to 1",
+	}, []string{"app", "decision"})
+	scaleEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scale_events_total",
+		Help:      "Number of replicas updates made on the app",
+	}, []string{"app", "direction"})
+	dryRunScaleEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_scale_events_total",
+		Help:      "Number of replicas updates that would have been made on the app in dry run",
+	}, []string{"app", "direction"})
+	rmqRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rmq_request_duration_seconds",
+		Help:      "Latency of the requests made to the RabbitMQ API",
+		Buckets:   prometheus.DefBuckets,
+	})
+	rmqRequestErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rmq_request_errors_total",
+		Help:      "Number of failed requests made to the RabbitMQ API",
+	})
+	rmqErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rmq_errors_total",
+		Help:      "Number of ticks where the queues of the app could not be read from RabbitMQ",
+	}, []string{"app"})
+	appQueueErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "app_queue_errors_total",
+		Help:      "Number of ticks where the queues of the app could not be read, by kind (NotFound, AuthFailed, Unavailable, Other)",
+	}, []string{"app", "kind"})
+	consecutiveFailuresGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consecutive_failures",
+		Help:      "Consecutive ticks where the queues of the app could not be read, reset once they are read",
+	}, []string{"app"})
+	snapshotAgeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_age_seconds",
+		Help:      "Age of the queues snapshot of the vhost used by the last tick, credentials is the Secret used to read it",
+	}, []string{"backend", "cluster", "vhost", "credentials"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		queueMessagesGauge,
+		queueConsumersGauge,
+		queueRateGauge,
+		appQueueMessagesGauge,
+		appQueueWorkersGauge,
+		replicasGauge,
+		desiredReplicasGauge,
+		minWorkersGauge,
+		maxWorkersGauge,
+		offsetGauge,
+		scheduleWindowGauge,
+		lastDecisionGauge,
+		scaleEventsCounter,
+		dryRunScaleEventsCounter,
+		rmqRequestDuration,
+		rmqRequestErrorsCounter,
+		rmqErrorsCounter,
+		appQueueErrorsCounter,
+		consecutiveFailuresGauge,
+		snapshotAgeGauge,
+	)
+}
+
+// serveMetrics expose the prometheus metrics on /metrics
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	klog.Infof("Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Metrics server stopped (%s)", err)
+	}
+}
+
+func observeRmqRequest(start time.Time, err error) {
+	rmqRequestDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		rmqRequestErrorsCounter.Inc()
+	}
+}
+
+// otherErrorKind kind of the errors that are not a sourceError in the metrics
+const otherErrorKind sourceErrorKind = "Other"
+
+func observeQueueError(app *App, err error) {
+	kind := errorKind(err)
+	if len(kind) == 0 {
+		kind = otherErrorKind
+	}
+	rmqErrorsCounter.WithLabelValues(app.key).Inc()
+	appQueueErrorsCounter.WithLabelValues(app.key, string(kind)).Inc()
+	observeFailures(app)
+}
+
+func observeFailures(app *App) {
+	consecutiveFailuresGauge.WithLabelValues(app.key).Set(float64(app.failures))
+}
+
+func observeSnapshotAge(key snapshotKey, age time.Duration) {
+	snapshotAgeGauge.WithLabelValues(key.backend, key.cluster, key.vhost, key.credentials).Set(age.Seconds())
+}
+
+func forgetSnapshotAge(key snapshotKey) {
+	snapshotAgeGauge.DeleteLabelValues(key.backend, key.cluster, key.vhost, key.credentials)
+}
+
+func observeQueue(app *App, consumers int32, queueSize int32) {
+	queueMessagesGauge.WithLabelValues(app.key).Set(float64(queueSize))
+	queueConsumersGauge.WithLabelValues(app.key).Set(float64(consumers))
+
+	var publishRate, deliverRate, ackRate float64
+	for _, queue := range app.queues {
+		rate, _ := queue.stats.publishRate()
+		publishRate += rate
+		deliverRate += queue.stats.deliverRate()
+		ackRate += queue.stats.ackRate()
+
+		appQueueMessagesGauge.WithLabelValues(app.key, queue.key()).Set(float64(queue.messages))
+	}
+
+	queueRateGauge.WithLabelValues(app.key, "publish").Set(publishRate)
+	queueRateGauge.WithLabelValues(app.key, "deliver_get").Set(deliverRate)
+	queueRateGauge.WithLabelValues(app.key, "ack").Set(ackRate)
+}
+
+func observeDecision(app *App, desiredReplicas int32) {
+	replicasGauge.WithLabelValues(app.key).Set(float64(app.replicas))
+	desiredReplicasGauge.WithLabelValues(app.key).Set(float64(desiredReplicas))
+	minWorkersGauge.WithLabelValues(app.key).Set(float64(app.minWorkers))
+	maxWorkersGauge.WithLabelValues(app.key).Set(float64(app.maxWorkers))
+	offsetGauge.WithLabelValues(app.key).Set(float64(app.offset))
+
+	for _, queue := range app.queues {
+		appQueueWorkersGauge.WithLabelValues(app.key, queue.key()).Set(float64(queue.workers))
+	}
+
+	for _, decision := range decisions {
+		value := 0.0
+		if decision == app.decision {
+			value = 1
+		}
+		lastDecisionGauge.WithLabelValues(app.key, decision).Set(value)
+	}
+}
+
+func observeSchedule(app *App) {
+	for _, window := range app.schedule {
+		value := 0.0
+		if window.Name == app.window {
+			value = 1
+		}
+		scheduleWindowGauge.WithLabelValues(app.key, window.Name).Set(value)
+	}
+}
+
+func observeScaleEvent(app *App, increment int32) {
+	direction := decisionUp
+	if increment < 0 {
+		direction = decisionDown
+	}
+	scaleEventsCounter.WithLabelValues(app.key, direction).Inc()
+}
+
+func observeDryRunScaleEvent(app *App, increment int32) {
+	direction := decisionUp
+	if increment < 0 {
+		direction = decisionDown
+	}
+	dryRunScaleEventsCounter.WithLabelValues(app.key, direction).Inc()
+}
+
+// forgetMetrics removes all the series of a deleted app
+func forgetMetrics(app *App) {
+	key := app.key
+	forgetQueueMetrics(app)
+
+	queueMessagesGauge.DeleteLabelValues(key)
+	queueConsumersGauge.DeleteLabelValues(key)
+	replicasGauge.DeleteLabelValues(key)
+	desiredReplicasGauge.DeleteLabelValues(key)
+	minWorkersGauge.DeleteLabelValues(key)
+	maxWorkersGauge.DeleteLabelValues(key)
+	offsetGauge.DeleteLabelValues(key)
+	consecutiveFailuresGauge.DeleteLabelValues(key)
+
+	rmqErrorsCounter.DeleteLabelValues(key)
+
+	for _, kind := range []sourceErrorKind{SourceNotFound, SourceAuthFailed, SourceUnavailable, otherErrorKind} {
+		appQueueErrorsCounter.DeleteLabelValues(key, string(kind))
+	}
+
+	for _, kind := range []string{"publish", "deliver_get", "ack"} {
+		queueRateGauge.DeleteLabelValues(key, kind)
+	}
+
+	for _, decision := range decisions {
+		lastDecisionGauge.DeleteLabelValues(key, decision)
+		scaleEventsCounter.DeleteLabelValues(key, decision)
+		dryRunScaleEventsCounter.DeleteLabelValues(key, decision)
+	}
+}
+
+// forgetQueueMetrics removes the series of the queues and schedule windows of an app, they may change on update
+func forgetQueueMetrics(app *App) {
+	for _, queue := range app.queues {
+		appQueueMessagesGauge.DeleteLabelValues(app.key, queue.key())
+		appQueueWorkersGauge.DeleteLabelValues(app.key, queue.key())
+	}
+
+	for _, window := range app.schedule {
+		scheduleWindowGauge.DeleteLabelValues(app.key, window.Name)
+	}
+}
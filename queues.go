@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// AggregationSum Workers needed by each queue are added
+	AggregationSum = "sum"
+	// AggregationMax Workers needed by the most loaded queue are used
+	AggregationMax = "max"
+
+	invalidPatternError = "workload: %s property `%s` is not a valid glob or /regex/ (%s)"
+	invalidQueueError   = "workload: %s property `%s` is not valid, expected `vhost/queue[:messages-per-worker]` (ex: %%2F/retry:10)"
+)
+
+// appQueue a queue consumed by the workers of an app
+type appQueue struct {
+	backend           string
+	cluster           string
+	credentials       string
+	vhost             string
+	name              string
+	pattern           *queuePattern
+	matches           int
+	messagesPerWorker int32
+	messages          int32
+	consumers         int32
+	stats             *QueueRates
+	oldestMessage     time.Time
+	workers           int32
+}
+
+// key returns the name of the queue used in the logs and metrics (ex: vhost/queue)
+func (q *appQueue) key() string {
+	return q.vhost + "/" + q.name
+}
+
+// snapshotKey returns the vhost of the queue in the snapshots
+func (q *appQueue) snapshotKey() snapshotKey {
+	return snapshotKey{backend: q.backend, cluster: q.cluster, credentials: q.credentials, vhost: q.vhost}
+}
+
+// update stores the last information fetched from the backend.
+// With a pattern, the messages, consumers and rates of the matching queues are added, the oldest message is kept
+func (q *appQueue) update(infos ...*QueueStats) {
+	q.matches = len(infos)
+	q.messages = 0
+	q.consumers = 0
+	q.stats = nil
+	q.oldestMessage = time.Time{}
+
+	for _, info := range infos {
+		q.messages += info.Messages
+		q.consumers += info.Consumers
+		q.stats = q.stats.add(info.Rates)
+
+		if !info.OldestMessage.IsZero() && (q.oldestMessage.IsZero() || info.OldestMessage.Before(q.oldestMessage)) {
+			q.oldestMessage = info.OldestMessage
+		}
+	}
+}
+
+// queuePattern matches the queue names with a glob (ex: orders.shard-*) or a regex between slashes (ex: /^orders\.shard-[0-9]+$/)
+type queuePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func parseQueuePattern(key string, pattern string) (*queuePattern, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		compiled, err := regexp.Compile(pattern[1 : len(pattern)-1])
+
+		if err != nil {
+			return nil, fmt.Errorf(invalidPatternError, key, QueuePattern, err)
+		}
+
+		return &queuePattern{regexp: compiled}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+		return nil, fmt.Errorf(invalidPatternError, key, QueuePattern, path.ErrBadPattern)
+	}
+
+	return &queuePattern{glob: pattern}, nil
+}
+
+func (p *queuePattern) match(name string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(name)
+	}
+
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// filter returns the queues with a matching name
+func (p *queuePattern) filter(queues []*QueueStats) []*QueueStats {
+	var matching []*QueueStats
+
+	for _, queue := range queues {
+		if p.match(queue.Name) {
+			matching = append(matching, queue)
+		}
+	}
+
+	return matching
+}
+
+// splitMessagesPerWorker splits the `:messages-per-worker` suffix of the queue, returns false without a numeric suffix.
+// A queue name may contain `:` (ex: `events:orders`), only a suffix made of digits is read as the messages per worker
+func splitMessagesPerWorker(queue string) (string, string, bool) {
+	separator := strings.LastIndex(queue, ":")
+
+	if separator < 0 || separator == len(queue)-1 {
+		return queue, "", false
+	}
+
+	for _, c := range queue[separator+1:] {
+		if c < '0' || c > '9' {
+			return queue, "", false
+		}
+	}
+
+	return queue[:separator], queue[separator+1:], true
+}
+
+// parseQueues parses a list of queues separated by commas, each formatted as `vhost/queue[:messages-per-worker]`.
+// The vhost is URL-escaped (ex: `%2F` for the default vhost), it's everything before the first `/` and the queue name may contain `/`
+func parseQueues(key string, queues string, messagesPerWorker int32) ([]*appQueue, error) {
+	var parsed []*appQueue
+
+	for _, queue := range strings.Split(queues, ",") {
+		queue = strings.TrimSpace(queue)
+
+		if len(queue) == 0 {
+			continue
+		}
+
+		q := &appQueue{messagesPerWorker: messagesPerWorker}
+
+		if name, suffix, ok := splitMessagesPerWorker(queue); ok {
+			perWorker, err := strconv.ParseInt(suffix, 10, 32)
+
+			if err != nil || perWorker < 1 {
+				return nil, fmt.Errorf(invalidQueueError, key, Queues)
+			}
+
+			q.messagesPerWorker = int32(perWorker)
+			queue = name
+		}
+
+		separator := strings.Index(queue, "/")
+
+		if separator <= 0 || separator == len(queue)-1 {
+			return nil, fmt.Errorf(invalidQueueError, key, Queues)
+		}
+
+		q.vhost = queue[:separator]
+		q.name = queue[separator+1:]
+		parsed = append(parsed, q)
+	}
+
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf(invalidQueueError, key, Queues)
+	}
+
+	return parsed, nil
+}
+
+// add returns the sum of the rates of both queues
+func (rates *QueueRates) add(other *QueueRates) *QueueRates {
+	if rates == nil {
+		return other
+	}
+	if other == nil {
+		return rates
+	}
+
+	return &QueueRates{
+		Publish: addRate(rates.Publish, other.Publish),
+		Deliver: addRate(rates.Deliver, other.Deliver),
+		Ack:     addRate(rates.Ack, other.Ack),
+	}
+}
+
+func addRate(rate *float64, other *float64) *float64 {
+	if rate == nil {
+		return other
+	}
+	if other == nil {
+		return rate
+	}
+	sum := *rate + *other
+	return &sum
+}
+
+// publishRate returns the incoming rate of the queue, false if the backend has no stats for it
+func (rates *QueueRates) publishRate() (float64, bool) {
+	if rates == nil || rates.Publish == nil {
+		return 0, false
+	}
+	return *rates.Publish, true
+}
+
+// workersRate returns the messages per second handled by the consumers, the ack rate or the deliver rate for auto ack consumers
+func (rates *QueueRates) workersRate() float64 {
+	if rate := rates.ackRate(); rate > 0 {
+		return rate
+	}
+	return rates.deliverRate()
+}
+
+func (rates *QueueRates) deliverRate() float64 {
+	if rates == nil || rates.Deliver == nil {
+		return 0
+	}
+	return *rates.Deliver
+}
+
+func (rates *QueueRates) ackRate() float64 {
+	if rates == nil || rates.Ack == nil {
+		return 0
+	}
+	return *rates.Ack
+}
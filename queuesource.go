@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultBackend Backend used by the apps without a backend annotation, the RabbitMQ management API
+const DefaultBackend = "rabbitmq"
+
+// QueueSource reads the queues of a broker. New backends implement it and are registered by name in main,
+// with their own connection settings, the apps pick one with the backend annotation
+type QueueSource interface {
+	// ListQueues returns the depth and consumers of all the queues of a vhost, the group of queues of the broker
+	// named by the vhost annotation. The rates and the oldest message are optional, leave them unset when the broker doesn't provide them.
+	// The errors should be a sourceError, so the tick can tell a missing vhost, refused credentials and a broker down apart
+	ListQueues(ctx context.Context, vhost string) ([]*QueueStats, error)
+}
+
+// QueueStats state of a queue returned by a QueueSource, whatever the broker
+type QueueStats struct {
+	Name      string
+	Messages  int32
+	Consumers int32
+	// Rates nil when the broker has no rate for the queue
+	Rates *QueueRates
+	// OldestMessage publish time of the oldest message of the queue, zero when unknown
+	OldestMessage time.Time
+}
+
+// QueueRates messages per second going through a queue, each rate is nil when the broker doesn't provide it
+type QueueRates struct {
+	Publish *float64
+	// Deliver messages delivered to the consumers, acked or not
+	Deliver *float64
+	Ack     *float64
+}
+
+// sourceErrorKind kind of failure of a QueueSource, the tick reacts differently to each one
+type sourceErrorKind string
+
+const (
+	// SourceNotFound the vhost or the queue doesn't exist, the app is not scaled
+	SourceNotFound sourceErrorKind = "NotFound"
+	// SourceAuthFailed the credentials are refused, not retried and the last snapshot is not used
+	SourceAuthFailed sourceErrorKind = "AuthFailed"
+	// SourceUnavailable the broker can't be reached or failed, retried and the last snapshot can be used
+	SourceUnavailable sourceErrorKind = "Unavailable"
+)
+
+// sourceError error returned by a QueueSource, with its kind
+type sourceError struct {
+	kind sourceErrorKind
+	err  error
+}
+
+func newSourceError(kind sourceErrorKind, format string, args ...interface{}) error {
+	return &sourceError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+// errorKind returns the kind of the error, empty when it's not a sourceError (ex: a backend not configured)
+func errorKind(err error) sourceErrorKind {
+	if typed, ok := err.(*sourceError); ok {
+		return typed.kind
+	}
+	return ""
+}
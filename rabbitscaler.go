@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// ConditionValid RabbitScaler condition set when the spec and the scaleTargetRef are valid
+	ConditionValid = "Valid"
+	// ConditionActive RabbitScaler condition set when the queue information can be fetched
+	ConditionActive = "Active"
+	// ConditionAbleToScale RabbitScaler condition set when the last replicas update succeeded
+	ConditionAbleToScale = "AbleToScale"
+
+	// ValidSpecReason Condition reason used when the RabbitScaler is valid
+	ValidSpecReason = "ValidSpec"
+	// InvalidSpecReason Condition reason used when the RabbitScaler spec can't be parsed
+	InvalidSpecReason = "InvalidSpec"
+	// TargetNotFoundReason Condition reason used when the scaleTargetRef can't be resolved
+	TargetNotFoundReason = "TargetNotFound"
+	// TargetNotWatchedReason Condition and Event reason used when the resource of the scaleTargetRef is not watched
+	TargetNotWatchedReason = "TargetNotWatched"
+	// TargetConflictReason Condition reason used when the scaleTargetRef is already targeted by another RabbitScaler
+	TargetConflictReason = "TargetConflict"
+	// QueueFetchedReason Condition reason used when the queue information has been fetched
+	QueueFetchedReason = "QueueFetched"
+	// SucceededScaleReason Condition reason used when the last replicas update succeeded
+	SucceededScaleReason = "SucceededScale"
+)
+
+// scalerRetryPeriod period between two resolutions of the scaleTargetRef that could not be found
+const scalerRetryPeriod = 30 * time.Second
+
+const (
+	targetNotWatchedError = "RabbitScaler %s target %s is not watched, add %s.%s.%s to RESOURCES"
+	targetConflictError   = "RabbitScaler %s target %s is already scaled by the RabbitScaler %s"
+)
+
+// RabbitScalersResource Resource of the RabbitScaler custom resource definition
+var RabbitScalersResource = schema.GroupVersionResource{Group: "xcid.github.io", Version: "v1alpha1", Resource: "rabbitscalers"}
+
+// RabbitScaler custom resource used to configure the autoscaling of a workload without annotations
+type RabbitScaler struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RabbitScalerSpec   `json:"spec"`
+	Status RabbitScalerStatus `json:"status,omitempty"`
+}
+
+// RabbitScalerSpec configuration of the RabbitScaler, same settings as the annotations
+type RabbitScalerSpec struct {
+	ScaleTargetRef    autoscalingv1.CrossVersionObjectReference `json:"scaleTargetRef"`
+	Queue             string                                    `json:"queue"`
+	Vhost             string                                    `json:"vhost"`
+	Backend           string                                    `json:"backend,omitempty"`
+	Cluster           string                                    `json:"cluster,omitempty"`
+	CredentialsSecret string                                    `json:"credentialsSecret,omitempty"`
+	QueuePattern      string                                    `json:"queuePattern,omitempty"`
+	Queues            []RabbitScalerQueue                       `json:"queues,omitempty"`
+	QueuesAggregation string                                    `json:"queuesAggregation,omitempty"`
+	MinWorkers        int32                                     `json:"minWorkers"`
+	MaxWorkers        int32                                     `json:"maxWorkers"`
+	MessagesPerWorker *int32                                    `json:"messagesPerWorker,omitempty"`
+	RatePerWorker     string                                    `json:"ratePerWorker,omitempty"`
+	TargetDrainTime   string                                    `json:"targetDrainTime,omitempty"`
+	Steps             *int32                                    `json:"steps,omitempty"`
+	Offset            *int32                                    `json:"offset,omitempty"`
+	Override          *bool                                     `json:"override,omitempty"`
+	SafeUnscale       *bool                                     `json:"safeUnscale,omitempty"`
+	CoolDownDelay     string                                    `json:"cooldownDelay,omitempty"`
+	ScaleToZero       *bool                                     `json:"scaleToZero,omitempty"`
+	IdleDelay         string                                    `json:"idleDelay,omitempty"`
+	ActivationWorkers *int32                                    `json:"activationWorkers,omitempty"`
+	DryRun            *bool                                     `json:"dryRun,omitempty"`
+	Paused            *bool                                     `json:"paused,omitempty"`
+	PinReplicas       *int32                                    `json:"pinReplicas,omitempty"`
+	PinUntil          string                                    `json:"pinUntil,omitempty"`
+	FailurePolicy     string                                    `json:"failurePolicy,omitempty"`
+	FailureThreshold  *int32                                    `json:"failureThreshold,omitempty"`
+	FallbackReplicas  *int32                                    `json:"fallbackReplicas,omitempty"`
+	Schedule          []ScheduleWindow                          `json:"schedule,omitempty"`
+	Behavior          *ScalingBehavior                          `json:"behavior,omitempty"`
+}
+
+// RabbitScalerQueue other queue consumed by the workers
+type RabbitScalerQueue struct {
+	Vhost             string `json:"vhost"`
+	Queue             string `json:"queue"`
+	MessagesPerWorker *int32 `json:"messagesPerWorker,omitempty"`
+}
+
+// RabbitScalerStatus last state observed by the autoscaler
+type RabbitScalerStatus struct {
+	QueueMessages   int32  `json:"queueMessages"`
+	QueueConsumers  int32  `json:"queueConsumers"`
+	CurrentReplicas int32  `json:"currentReplicas"`
+	DesiredReplicas int32  `json:"desiredReplicas"`
+	LastDecision    string `json:"lastDecision,omitempty"`
+	// ConsecutiveFailures ticks where the queues could not be read since the last successful read
+	ConsecutiveFailures int32                   `json:"consecutiveFailures"`
+	LastScaleTime       *metav1.Time            `json:"lastScaleTime,omitempty"`
+	Conditions          []RabbitScalerCondition `json:"conditions,omitempty"`
+}
+
+// RabbitScalerCondition state of one aspect of the RabbitScaler
+type RabbitScalerCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+func newRabbitScaler(object *unstructured.Unstructured) (*RabbitScaler, error) {
+	scaler := &RabbitScaler{}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, scaler); err != nil {
+		return nil, err
+	}
+
+	return scaler, nil
+}
+
+// key returns the unique key of the RabbitScaler (ex: namespace/name)
+func (rs *RabbitScaler) key() string {
+	return rs.Namespace + "/" + rs.Name
+}
+
+// reference returns the reference of the RabbitScaler, used to record events on it
+func (rs *RabbitScaler) reference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion:      RabbitScalersResource.GroupVersion().String(),
+		Kind:            "RabbitScaler",
+		Namespace:       rs.Namespace,
+		Name:            rs.Name,
+		UID:             rs.UID,
+		ResourceVersion: rs.ResourceVersion,
+	}
+}
+
+// annotations converts the spec to the equivalent annotations, parsed by createApp
+func (rs *RabbitScaler) annotations() map[string]string {
+	annotations := map[string]string{
+		AnnotationPrefix + Enable:     "true",
+		AnnotationPrefix + MinWorkers: strconv.FormatInt(int64(rs.Spec.MinWorkers), 10),
+		AnnotationPrefix + MaxWorkers: strconv.FormatInt(int64(rs.Spec.MaxWorkers), 10),
+	}
+
+	if len(rs.Spec.Queue) > 0 {
+		annotations[AnnotationPrefix+Queue] = rs.Spec.Queue
+	}
+	if len(rs.Spec.Vhost) > 0 {
+		annotations[AnnotationPrefix+Vhost] = rs.Spec.Vhost
+	}
+	if len(rs.Spec.Backend) > 0 {
+		annotations[AnnotationPrefix+Backend] = rs.Spec.Backend
+	}
+	if len(rs.Spec.Cluster) > 0 {
+		annotations[AnnotationPrefix+Cluster] = rs.Spec.Cluster
+	}
+	if len(rs.Spec.CredentialsSecret) > 0 {
+		annotations[AnnotationPrefix+CredentialsSecret] = rs.Spec.CredentialsSecret
+	}
+	if len(rs.Spec.QueuePattern) > 0 {
+		annotations[AnnotationPrefix+QueuePattern] = rs.Spec.QueuePattern
+	}
+	if len(rs.Spec.Queues) > 0 {
+		var queues []string
+		for _, queue := range rs.Spec.Queues {
+			formatted := queue.Vhost + "/" + queue.Queue
+			if queue.MessagesPerWorker != nil {
+				formatted += ":" + strconv.FormatInt(int64(*queue.MessagesPerWorker), 10)
+			} else if _, _, ok := splitMessagesPerWorker(formatted); ok {
+				// The queue name ends with `:` and digits, the messages per worker of the spec keeps it in the name
+				perWorker := int32(1)
+				if rs.Spec.MessagesPerWorker != nil {
+					perWorker = *rs.Spec.MessagesPerWorker
+				}
+				formatted += ":" + strconv.FormatInt(int64(perWorker), 10)
+			}
+			queues = append(queues, formatted)
+		}
+		annotations[AnnotationPrefix+Queues] = strings.Join(queues, ",")
+	}
+	if len(rs.Spec.QueuesAggregation) > 0 {
+		annotations[AnnotationPrefix+QueuesAggregation] = rs.Spec.QueuesAggregation
+	}
+
+	if rs.Spec.MessagesPerWorker != nil {
+		annotations[AnnotationPrefix+MessagesPerWorker] = strconv.FormatInt(int64(*rs.Spec.MessagesPerWorker), 10)
+	}
+	if len(rs.Spec.RatePerWorker) > 0 {
+		annotations[AnnotationPrefix+RatePerWorker] = rs.Spec.RatePerWorker
+	}
+	if len(rs.Spec.TargetDrainTime) > 0 {
+		annotations[AnnotationPrefix+TargetDrainTime] = rs.Spec.TargetDrainTime
+	}
+	if rs.Spec.Steps != nil {
+		annotations[AnnotationPrefix+Steps] = strconv.FormatInt(int64(*rs.Spec.Steps), 10)
+	}
+	if rs.Spec.Offset != nil {
+		annotations[AnnotationPrefix+Offset] = strconv.FormatInt(int64(*rs.Spec.Offset), 10)
+	}
+	if rs.Spec.Override != nil {
+		annotations[AnnotationPrefix+Override] = strconv.FormatBool(*rs.Spec.Override)
+	}
+	if rs.Spec.SafeUnscale != nil {
+		annotations[AnnotationPrefix+SafeUnscale] = strconv.FormatBool(*rs.Spec.SafeUnscale)
+	}
+	if len(rs.Spec.CoolDownDelay) > 0 {
+		annotations[AnnotationPrefix+CoolDownDelay] = rs.Spec.CoolDownDelay
+	}
+	if rs.Spec.ScaleToZero != nil {
+		annotations[AnnotationPrefix+ScaleToZero] = strconv.FormatBool(*rs.Spec.ScaleToZero)
+	}
+	if len(rs.Spec.IdleDelay) > 0 {
+		annotations[AnnotationPrefix+IdleDelay] = rs.Spec.IdleDelay
+	}
+	if rs.Spec.ActivationWorkers != nil {
+		annotations[AnnotationPrefix+ActivationWorkers] = strconv.FormatInt(int64(*rs.Spec.ActivationWorkers), 10)
+	}
+	if rs.Spec.DryRun != nil {
+		annotations[AnnotationPrefix+DryRun] = strconv.FormatBool(*rs.Spec.DryRun)
+	}
+	if rs.Spec.Paused != nil {
+		annotations[AnnotationPrefix+Paused] = strconv.FormatBool(*rs.Spec.Paused)
+	}
+	if rs.Spec.PinReplicas != nil {
+		annotations[AnnotationPrefix+PinReplicas] = strconv.FormatInt(int64(*rs.Spec.PinReplicas), 10)
+	}
+	if len(rs.Spec.PinUntil) > 0 {
+		annotations[AnnotationPrefix+PinUntil] = rs.Spec.PinUntil
+	}
+	if len(rs.Spec.FailurePolicy) > 0 {
+		annotations[AnnotationPrefix+FailurePolicy] = rs.Spec.FailurePolicy
+	}
+	if rs.Spec.FailureThreshold != nil {
+		annotations[AnnotationPrefix+FailureThreshold] = strconv.FormatInt(int64(*rs.Spec.FailureThreshold), 10)
+	}
+	if rs.Spec.FallbackReplicas != nil {
+		annotations[AnnotationPrefix+FallbackReplicas] = strconv.FormatInt(int64(*rs.Spec.FallbackReplicas), 10)
+	}
+	if len(rs.Spec.Schedule) > 0 {
+		schedule, _ := json.Marshal(rs.Spec.Schedule)
+		annotations[AnnotationPrefix+Schedule] = string(schedule)
+	}
+	if rs.Spec.Behavior != nil {
+		behavior, _ := json.Marshal(rs.Spec.Behavior)
+		annotations[AnnotationPrefix+Behavior] = string(behavior)
+	}
+
+	return annotations
+}
+
+// getScaleTarget fetches the workload referenced by the scaleTargetRef.
+// It's called by the watch goroutine that the informers wait for, the requests are bounded by the app timeout
+func (a *Autoscaler) getScaleTarget(scaler *RabbitScaler) (*workload, error) {
+	ref := scaler.Spec.ScaleTargetRef
+
+	groupVersion, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := a.clients.mapper.RESTMapping(schema.GroupKind{Group: groupVersion.Group, Kind: ref.Kind}, groupVersion.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := a.clients.requests.Resource(mapping.Resource).Namespace(scaler.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return newWorkload(mapping.Resource, object), nil
+}
+
+// rabbitScalerHandler sends the RabbitScalers to the autoscaler
+func (a *Autoscaler) rabbitScalerHandler(key string, object *unstructured.Unstructured) {
+	if object == nil {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		a.deleteScaler <- &RabbitScaler{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		return
+	}
+
+	scaler, err := newRabbitScaler(object)
+
+	if err != nil {
+		klog.Errorf("RabbitScaler %s can't be read (%s)", key, err)
+		return
+	}
+
+	a.addScaler <- scaler
+}
+
+func (a *Autoscaler) addRabbitScaler(scaler *RabbitScaler) {
+	// The generation only changes with the spec, skip our own status updates
+	if previous, ok := a.scalers[a.scalerTargets[scaler.key()]]; ok && previous.Generation == scaler.Generation {
+		return
+	}
+
+	target, err := a.getScaleTarget(scaler)
+
+	if err != nil {
+		// The target may be created after the RabbitScaler or the API may time out, it's resolved again every scalerRetryPeriod
+		klog.Errorf("RabbitScaler %s target can't be resolved, retrying in %s (%s)", scaler.key(), scalerRetryPeriod, err)
+		a.unresolvedScalers[scaler.key()] = scaler
+		a.setValidity(scaler, corev1.ConditionFalse, TargetNotFoundReason, err.Error())
+		return
+	}
+
+	delete(a.unresolvedScalers, scaler.key())
+	targetKey := target.key()
+
+	// The scaleTargetRef changed, release the previous target
+	if previous, ok := a.scalerTargets[scaler.key()]; ok && previous != targetKey {
+		delete(a.scalerTargets, scaler.key())
+		a.releaseScalerTarget(previous)
+	}
+
+	// No informer would update the replicas of the target, it would be scaled from this snapshot forever
+	if !a.resources[target.resource] {
+		resource := target.resource
+		message := fmt.Sprintf(targetNotWatchedError, scaler.key(), target.key(), resource.Resource, resource.Version, resource.Group)
+		klog.Error(message)
+		a.setValidity(scaler, corev1.ConditionFalse, TargetNotWatchedReason, message)
+		a.recorder.Event(scaler.reference(), corev1.EventTypeWarning, TargetNotWatchedReason, message)
+		return
+	}
+
+	// The first RabbitScaler keeps the target, the other ones are resolved again every scalerRetryPeriod until it's released
+	if current, ok := a.scalers[targetKey]; ok && current.key() != scaler.key() {
+		message := fmt.Sprintf(targetConflictError, scaler.key(), targetKey, current.key())
+		klog.Error(message)
+		a.unresolvedScalers[scaler.key()] = scaler
+		a.setValidity(scaler, corev1.ConditionFalse, TargetConflictReason, message)
+		return
+	}
+
+	a.scalers[targetKey] = scaler
+	a.scalerTargets[scaler.key()] = targetKey
+	a.addWorkload(target)
+}
+
+// retryRabbitScalers resolves again the scaleTargetRef of the RabbitScalers whose target could not be found
+func (a *Autoscaler) retryRabbitScalers() {
+	for _, scaler := range a.unresolvedScalers {
+		a.addRabbitScaler(scaler)
+	}
+}
+
+func (a *Autoscaler) removeRabbitScaler(scaler *RabbitScaler) {
+	delete(a.unresolvedScalers, scaler.key())
+
+	a.mu.Lock()
+	delete(a.validities, scaler.key())
+	a.mu.Unlock()
+
+	if target, ok := a.scalerTargets[scaler.key()]; ok {
+		delete(a.scalerTargets, scaler.key())
+		a.releaseScalerTarget(target)
+	}
+}
+
+// releaseScalerTarget removes the app of the RabbitScaler target, the annotations of the workload apply again.
+// The informers resync is disabled, the workload may not be received again
+func (a *Autoscaler) releaseScalerTarget(target string) {
+	delete(a.scalers, target)
+	a.removeApp(target)
+
+	if workload, ok := a.scalerWorkloads[target]; ok {
+		delete(a.scalerWorkloads, target)
+		a.addWorkload(workload)
+	}
+}
+
+// scalerValidity Valid condition of a RabbitScaler, waiting to be written by the leader
+type scalerValidity struct {
+	scaler  *RabbitScaler
+	status  corev1.ConditionStatus
+	reason  string
+	message string
+}
+
+// setValidity records the Valid condition of the RabbitScaler, the informers never wait for the API.
+// Only the last condition of each RabbitScaler is kept until the leader writes it
+func (a *Autoscaler) setValidity(scaler *RabbitScaler, status corev1.ConditionStatus, reason string, message string) {
+	a.mu.Lock()
+	if a.validities == nil {
+		a.validities = make(map[string]scalerValidity)
+	}
+	a.validities[scaler.key()] = scalerValidity{scaler: scaler, status: status, reason: reason, message: message}
+	a.mu.Unlock()
+
+	select {
+	case a.validityUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// writeValidities writes the Valid conditions of the RabbitScalers until the leadership is lost
+func (a *Autoscaler) writeValidities(ctx context.Context) {
+	for {
+		a.flushValidities()
+
+		select {
+		case <-a.validityUpdates:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Autoscaler) flushValidities() {
+	a.mu.Lock()
+	validities := a.validities
+	a.validities = nil
+	a.mu.Unlock()
+
+	for _, validity := range validities {
+		validity := validity
+		a.updateScalerStatus(validity.scaler, func(status *RabbitScalerStatus) {
+			setCondition(status, ConditionValid, validity.status, validity.reason, validity.message)
+		})
+	}
+}
+
+// updateScalerStatus applies the update on the latest RabbitScaler status, retried on conflict.
+// It's only called by the leader, from the tick or writeValidities, each request is bounded by the app timeout
+func (a *Autoscaler) updateScalerStatus(scaler *RabbitScaler, update func(status *RabbitScalerStatus)) {
+	client := a.clients.requests.Resource(RabbitScalersResource).Namespace(scaler.Namespace)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := client.Get(scaler.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		current, err := newRabbitScaler(object)
+		if err != nil {
+			return err
+		}
+
+		status := current.Status.DeepCopy()
+		update(status)
+
+		if reflect.DeepEqual(status, &current.Status) {
+			return nil
+		}
+
+		current.Status = *status
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.UpdateStatus(&unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+		return err
+	})
+
+	if err != nil {
+		klog.Errorf("Error during RabbitScaler %s status update (%s)", scaler.key(), err)
+	}
+}
+
+// writeStatus copies the last observation of the app into the RabbitScaler status
+func (app *App) writeStatus(status *RabbitScalerStatus, queueErr error, scaleErr error) {
+	status.CurrentReplicas = app.replicas
+	status.DesiredReplicas = app.desiredReplicas
+	status.LastDecision = app.decision
+	status.ConsecutiveFailures = app.failures
+
+	if queueErr != nil {
+		setCondition(status, ConditionActive, corev1.ConditionFalse, queueErrorReason(queueErr), queueErr.Error())
+	} else if app.decision != decisionCoolDown {
+		status.QueueMessages = app.queueSize
+		status.QueueConsumers = app.consumers
+		setCondition(status, ConditionActive, corev1.ConditionTrue, QueueFetchedReason, fmt.Sprintf("queue %s fetched on vhost %s", app.queue, app.vhost))
+	}
+
+	if scaleErr != nil {
+		setCondition(status, ConditionAbleToScale, corev1.ConditionFalse, ScaleFailedReason, scaleErr.Error())
+	} else if !app.lastScaleTime.IsZero() {
+		lastScaleTime := metav1.NewTime(app.lastScaleTime).Rfc3339Copy()
+		status.LastScaleTime = &lastScaleTime
+		setCondition(status, ConditionAbleToScale, corev1.ConditionTrue, SucceededScaleReason, fmt.Sprintf("scaled to %d replicas", app.desiredReplicas))
+	}
+}
+
+// setCondition updates the condition, the transition time only changes with the status
+func setCondition(status *RabbitScalerStatus, conditionType string, conditionStatus corev1.ConditionStatus, reason string, message string) {
+	for i := range status.Conditions {
+		condition := &status.Conditions[i]
+
+		if condition.Type != conditionType {
+			continue
+		}
+
+		if condition.Status != conditionStatus {
+			condition.LastTransitionTime = metav1.Now().Rfc3339Copy()
+		}
+
+		condition.Status = conditionStatus
+		condition.Reason = reason
+		condition.Message = message
+		return
+	}
+
+	status.Conditions = append(status.Conditions, RabbitScalerCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now().Rfc3339Copy(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// DeepCopy returns a copy of the status
+func (in *RabbitScalerStatus) DeepCopy() *RabbitScalerStatus {
+	out := *in
+
+	if in.LastScaleTime != nil {
+		out.LastScaleTime = in.LastScaleTime.DeepCopy()
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]RabbitScalerCondition, len(in.Conditions))
+		copy(out.Conditions, in.Conditions)
+	}
+
+	return &out
+}
@@ -1,24 +1,69 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// rmqRetries retries of an unavailable RabbitMQ API, within the timeout of the app
+	rmqRetries = 2
 )
 
+// rmqRetryBackoff delay before the first retry, doubled after each one
+var rmqRetryBackoff = 200 * time.Millisecond
+
 type rmq struct {
 	URL      string
 	User     string
 	Password string
+	client   *http.Client
+}
+
+// queueColumns fields of the queues returned by RabbitMQ, the other ones are not used by the autoscaler
+var queueColumns = []string{
+	"name",
+	"consumers",
+	"messages",
+	"head_message_timestamp",
+	"message_stats.publish_details.rate",
+	"message_stats.deliver_get_details.rate",
+	"message_stats.ack_details.rate",
 }
 
+// queueResponse queue returned by the management API, converted to QueueStats
 type queueResponse struct {
-	Consumers int32 `json:"consumers"`
-	Messages  int32 `json:"messages"`
+	Name         string        `json:"name"`
+	Consumers    int32         `json:"consumers"`
+	Messages     int32         `json:"messages"`
+	MessageStats *messageStats `json:"message_stats"`
+	// HeadMessageTimestamp timestamp property of the oldest message, only filled when the publisher sets it
+	HeadMessageTimestamp *int64 `json:"head_message_timestamp"`
+}
+
+// messageStats rates of the queue, only filled by RabbitMQ once messages went through the queue
+type messageStats struct {
+	PublishDetails    *rateDetails `json:"publish_details"`
+	DeliverGetDetails *rateDetails `json:"deliver_get_details"`
+	AckDetails        *rateDetails `json:"ack_details"`
+}
+
+// rateDetails rate in messages per second
+type rateDetails struct {
+	Rate float64 `json:"rate"`
 }
 
-func newRmq(rmqURL string, rmqUser string, rmqPassword string) (*rmq, error) {
+func newRmq(rmqURL string, rmqUser string, rmqPassword string, client *http.Client) (*rmq, error) {
 
 	if len(rmqURL) == 0 || len(rmqUser) == 0 || len(rmqPassword) == 0 {
 		return nil, errors.New("missing rmq information")
@@ -28,29 +73,121 @@ func newRmq(rmqURL string, rmqUser string, rmqPassword string) (*rmq, error) {
 		URL:      rmqURL,
 		User:     rmqUser,
 		Password: rmqPassword,
+		client:   client,
 	}, nil
 }
 
-func (rmq *rmq) getQueueInformation(queue string, vhost string) (int32, int32, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/queues/%s/%s", rmq.URL, vhost, queue), nil)
+// withCredentials returns a copy of the connection using other credentials, the http client is shared
+func (rmq *rmq) withCredentials(user string, password string) QueueSource {
+	copy := *rmq
+	copy.User = user
+	copy.Password = password
+	return &copy
+}
+
+// ListQueues returns all the queues of a vhost from the management API, only the columns used by the autoscaler are fetched.
+// The unavailable errors are retried with a backoff while the context allows it
+func (rmq *rmq) ListQueues(ctx context.Context, vhost string) ([]*QueueStats, error) {
+	backoff := rmqRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		queues, err := rmq.listQueues(ctx, vhost)
+
+		if err == nil {
+			stats := make([]*QueueStats, 0, len(queues))
+			for _, queue := range queues {
+				stats = append(stats, queue.stats())
+			}
+			return stats, nil
+		}
+
+		if errorKind(err) != SourceUnavailable || attempt >= rmqRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		klog.Warningf("Unable to list the queues of vhost %s, retrying in %s (%s)", vhost, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+func (rmq *rmq) listQueues(ctx context.Context, vhost string) ([]*queueResponse, error) {
+	query := url.Values{"columns": {strings.Join(queueColumns, ",")}}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/queues/%s?%s", rmq.URL, escapeVhost(vhost), query.Encode()), nil)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	req.SetBasicAuth(rmq.User, rmq.Password)
-	resp, err := client.Do(req)
+	resp, err := rmq.client.Do(req.WithContext(ctx))
 
 	if err != nil {
-		return 0, 0, err
+		return nil, newSourceError(SourceUnavailable, "%s", err)
 	}
 
-	if resp.StatusCode != 200 {
-		return 0, 0, errors.New(resp.Status)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
 	}
 
-	defer resp.Body.Close()
-	var data queueResponse
-	json.NewDecoder(resp.Body).Decode(&data)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, newSourceError(SourceNotFound, "vhost %s not found", vhost)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, newSourceError(SourceAuthFailed, "user %s can't read vhost %s (%s)", rmq.User, vhost, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, newSourceError(SourceUnavailable, "%s", resp.Status)
+	}
+
+	var data []*queueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, newSourceError(SourceUnavailable, "invalid response (%s)", err)
+	}
+
+	return data, nil
+}
+
+// escapeVhost escapes the vhost in the path, the vhosts already escaped (ex: %2F) are kept as is
+func escapeVhost(vhost string) string {
+	if unescaped, err := url.PathUnescape(vhost); err == nil {
+		vhost = unescaped
+	}
+	return url.PathEscape(vhost)
+}
+
+// stats converts the queue returned by the management API
+func (response *queueResponse) stats() *QueueStats {
+	stats := &QueueStats{
+		Name:      response.Name,
+		Messages:  response.Messages,
+		Consumers: response.Consumers,
+	}
+
+	if response.MessageStats != nil {
+		stats.Rates = &QueueRates{
+			Publish: response.MessageStats.PublishDetails.rate(),
+			Deliver: response.MessageStats.DeliverGetDetails.rate(),
+			Ack:     response.MessageStats.AckDetails.rate(),
+		}
+	}
 
-	return data.Consumers, data.Messages, nil
+	if response.HeadMessageTimestamp != nil {
+		stats.OldestMessage = time.Unix(*response.HeadMessageTimestamp, 0)
+	}
+
+	return stats
+}
+
+func (details *rateDetails) rate() *float64 {
+	if details == nil {
+		return nil
+	}
+	rate := details.Rate
+	return &rate
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// tlsOptions TLS settings of the connection to the management API, the system CAs are used by default
+type tlsOptions struct {
+	// CAFile PEM bundle of the CAs trusted to sign the certificate of the management API
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile client certificate, for mutual TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ServerName name checked in the certificate instead of the host of the URL
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// config returns the TLS config of the options
+func (options tlsOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	if len(options.CAFile) > 0 {
+		content, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", options.CAFile)
+		}
+	}
+
+	if len(options.CertFile) > 0 != (len(options.KeyFile) > 0) {
+		return nil, errors.New("the client certificate and key must be set together")
+	}
+
+	if len(options.CertFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// newHTTPClient creates the client of a cluster, reused by every tick so the connections are kept alive.
+// The timeout bounds each request, 0 to only rely on the timeout of the app
+func newHTTPClient(options tlsOptions, timeout time.Duration) (*http.Client, error) {
+	config, err := options.config()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.InsecureSkipVerify {
+		klog.Warning("The certificate of the RabbitMQ management API is not verified")
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
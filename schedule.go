@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	invalidScheduleError       = "workload: %s property `%s` is not a valid list of windows (%s)"
+	invalidScheduleWindowError = "workload: %s property `%s` window %s is not valid (%s)"
+)
+
+// ScheduleWindow limits applied from each start of the cron expression during the duration.
+// The limits that are not set keep the value of the annotations
+type ScheduleWindow struct {
+	Name       string `json:"name,omitempty"`
+	Cron       string `json:"cron"`
+	Duration   string `json:"duration"`
+	Timezone   string `json:"timezone,omitempty"`
+	MinWorkers *int32 `json:"minWorkers,omitempty"`
+	MaxWorkers *int32 `json:"maxWorkers,omitempty"`
+	Offset     *int32 `json:"offset,omitempty"`
+}
+
+// scheduleLimits limits of an app, from the annotations or from the open schedule window
+type scheduleLimits struct {
+	minWorkers int32
+	maxWorkers int32
+	offset     int32
+}
+
+// scheduleWindow parsed ScheduleWindow
+type scheduleWindow struct {
+	ScheduleWindow
+	schedule cron.Schedule
+	duration time.Duration
+	location *time.Location
+}
+
+// parseSchedule parses the windows of the schedule annotation, a YAML or JSON list
+func parseSchedule(key string, value string, defaults scheduleLimits) ([]*scheduleWindow, error) {
+	var windows []ScheduleWindow
+
+	if err := yaml.Unmarshal([]byte(value), &windows); err != nil {
+		return nil, fmt.Errorf(invalidScheduleError, key, Schedule, err)
+	}
+
+	var parsed []*scheduleWindow
+
+	for i, window := range windows {
+		if len(window.Name) == 0 {
+			window.Name = fmt.Sprintf("window-%d", i)
+		}
+
+		schedule, err := cron.ParseStandard(window.Cron)
+		if err != nil {
+			return nil, fmt.Errorf(invalidScheduleWindowError, key, Schedule, window.Name, err)
+		}
+
+		duration, err := time.ParseDuration(window.Duration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf(invalidScheduleWindowError, key, Schedule, window.Name, "duration must be a positive duration (ex: 10h)")
+		}
+
+		location, err := time.LoadLocation(window.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf(invalidScheduleWindowError, key, Schedule, window.Name, err)
+		}
+
+		parsedWindow := &scheduleWindow{ScheduleWindow: window, schedule: schedule, duration: duration, location: location}
+		limits := parsedWindow.limits(defaults)
+
+		if limits.minWorkers < 0 {
+			return nil, fmt.Errorf(invalidScheduleWindowError, key, Schedule, window.Name, "minWorkers must not be negative")
+		}
+
+		if limits.minWorkers > limits.maxWorkers {
+			return nil, fmt.Errorf(invalidScheduleWindowError, key, Schedule, window.Name, "minWorkers must be lower or equal to maxWorkers")
+		}
+
+		parsed = append(parsed, parsedWindow)
+	}
+
+	return parsed, nil
+}
+
+// isOpen returns true when the window started less than its duration ago.
+// The cron expression is evaluated in the timezone of the window (Default: UTC)
+func (w *scheduleWindow) isOpen(now time.Time) bool {
+	start := w.schedule.Next(now.In(w.location).Add(-w.duration))
+	return !start.After(now)
+}
+
+// limits returns the limits of the window, the limits not set are taken from the defaults
+func (w *scheduleWindow) limits(defaults scheduleLimits) scheduleLimits {
+	limits := defaults
+
+	if w.MinWorkers != nil {
+		limits.minWorkers = *w.MinWorkers
+	}
+	if w.MaxWorkers != nil {
+		limits.maxWorkers = *w.MaxWorkers
+	}
+	if w.Offset != nil {
+		limits.offset = *w.Offset
+	}
+
+	return limits
+}
+
+// applySchedule sets the limits of the first open window of the schedule, the windows listed first take precedence.
+// The limits of the annotations are used when no window is open
+func (app *App) applySchedule(now time.Time) {
+	if len(app.schedule) == 0 {
+		return
+	}
+
+	limits, name := app.defaultLimits, ""
+
+	for _, window := range app.schedule {
+		if window.isOpen(now) {
+			limits, name = window.limits(app.defaultLimits), window.Name
+			break
+		}
+	}
+
+	if name != app.window {
+		if len(name) == 0 {
+			klog.Infof("%s schedule window %s is over, back to the default limits (min: %d / max: %d / offset: %d)", app.key, app.window, limits.minWorkers, limits.maxWorkers, limits.offset)
+		} else {
+			klog.Infof("%s schedule window %s is open (min: %d / max: %d / offset: %d)", app.key, name, limits.minWorkers, limits.maxWorkers, limits.offset)
+		}
+	}
+
+	app.window = name
+	app.minWorkers = limits.minWorkers
+	app.maxWorkers = limits.maxWorkers
+	app.offset = limits.offset
+	observeSchedule(app)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	queueNotFoundError           = "queue %s not found on vhost %s"
+	patternNotMatchedError       = "no queue matches %s on vhost %s"
+	unknownBackendError          = "backend %s is not configured"
+	vhostNotInSnapshotError      = "vhost %s of %s not in snapshot"
+	credentialsNotSupportedError = "backend %s doesn't support the credentials secrets"
+)
+
+// snapshotter fetches the queues of each vhost once per tick and keeps the last successful fetch,
+// used when the backend is unavailable
+type snapshotter struct {
+	sources queueSources
+	// credentials Secrets used by the apps with their own credentials, nil when the Secrets are not watched
+	credentials *credentialsStore
+	// maxAge how long the last successful fetch of a vhost can be used when the backend can't be reached, 0 to disable
+	maxAge time.Duration
+	// workers vhosts listed concurrently, timeout bounds the listing of each vhost, 0 to only rely on the context
+	workers int
+	timeout time.Duration
+	last    map[snapshotKey]*vhostSnapshot
+}
+
+// snapshotKey vhost of a cluster, read with the credentials of a Secret (namespace/name) or of the cluster when empty
+type snapshotKey struct {
+	backend     string
+	cluster     string
+	credentials string
+	vhost       string
+}
+
+// queueSnapshot queues of the vhosts used by the apps during a tick
+type queueSnapshot struct {
+	vhosts map[snapshotKey]*vhostSnapshot
+	errors map[snapshotKey]error
+}
+
+// vhostSnapshot queues of a vhost, indexed by name
+type vhostSnapshot struct {
+	fetchedAt time.Time
+	queues    []*QueueStats
+	byName    map[string]*QueueStats
+}
+
+func newSnapshotter(sources queueSources, maxAge time.Duration) *snapshotter {
+	return &snapshotter{
+		sources: sources,
+		maxAge:  maxAge,
+		last:    make(map[snapshotKey]*vhostSnapshot),
+	}
+}
+
+// listing queues of a vhost listed during the refresh, listed is false when its source can't be used
+type listing struct {
+	queues []*QueueStats
+	err    error
+	listed bool
+}
+
+// refresh lists the queues of each vhost with a single call
+func (s *snapshotter) refresh(ctx context.Context, keys []snapshotKey) *queueSnapshot {
+	snapshot := &queueSnapshot{
+		vhosts: make(map[snapshotKey]*vhostSnapshot),
+		errors: make(map[snapshotKey]error),
+	}
+	requested := make(map[snapshotKey]bool)
+	listings := s.list(ctx, keys)
+
+	for i, key := range keys {
+		requested[key] = true
+		queues, err := listings[i].queues, listings[i].err
+
+		if !listings[i].listed {
+			snapshot.errors[key] = err
+			continue
+		}
+
+		if err == nil {
+			s.last[key] = newVhostSnapshot(queues)
+		} else if last, ok := s.last[key]; ok && errorKind(err) == SourceUnavailable && time.Since(last.fetchedAt) <= s.maxAge {
+			klog.Warningf("Unable to list the queues of vhost %s on %s, using the snapshot of %s (%s)", key.vhost, key.source(), last.fetchedAt, err)
+		} else {
+			klog.Errorf("Unable to list the queues of vhost %s on %s (%s)", key.vhost, key.source(), err)
+			snapshot.errors[key] = err
+		}
+
+		if last, ok := s.last[key]; ok {
+			observeSnapshotAge(key, time.Since(last.fetchedAt))
+
+			if snapshot.errors[key] == nil {
+				snapshot.vhosts[key] = last
+			}
+		}
+	}
+
+	// Forget the vhosts no longer used
+	for key := range s.last {
+		if !requested[key] {
+			delete(s.last, key)
+			forgetSnapshotAge(key)
+		}
+	}
+
+	return snapshot
+}
+
+// list lists the queues of the vhosts concurrently with a bounded number of workers.
+// Each vhost has its own timeout, a slow or unreachable cluster doesn't use the time of the other vhosts
+func (s *snapshotter) list(ctx context.Context, keys []snapshotKey) []listing {
+	listings := make([]listing, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < s.workers || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				listings[job] = s.listVhost(ctx, keys[job])
+			}
+		}()
+	}
+
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return listings
+}
+
+func (s *snapshotter) listVhost(ctx context.Context, key snapshotKey) listing {
+	source, err := s.source(key)
+	if err != nil {
+		return listing{err: err}
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	queues, err := source.ListQueues(ctx, key.vhost)
+	observeRmqRequest(start, err)
+
+	return listing{queues: queues, err: err, listed: true}
+}
+
+// source returns the source of the key, with the credentials of the Secret when set
+func (s *snapshotter) source(key snapshotKey) (QueueSource, error) {
+	source, err := s.sources.get(key.backend, key.cluster)
+	if err != nil || len(key.credentials) == 0 {
+		return source, err
+	}
+
+	withCredentials, ok := source.(credentialsSource)
+	if !ok {
+		return nil, fmt.Errorf(credentialsNotSupportedError, key.backend)
+	}
+
+	credentials, err := s.credentials.get(key.credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return withCredentials.withCredentials(credentials.user, credentials.password), nil
+}
+
+func newVhostSnapshot(queues []*QueueStats) *vhostSnapshot {
+	snapshot := &vhostSnapshot{
+		fetchedAt: time.Now(),
+		queues:    queues,
+		byName:    make(map[string]*QueueStats, len(queues)),
+	}
+
+	for _, queue := range queues {
+		snapshot.byName[queue.Name] = queue
+	}
+
+	return snapshot
+}
+
+// get returns the queues of a vhost
+func (snapshot *queueSnapshot) get(key snapshotKey) (*vhostSnapshot, error) {
+	if err, ok := snapshot.errors[key]; ok {
+		return nil, err
+	}
+
+	if vhostSnapshot, ok := snapshot.vhosts[key]; ok {
+		return vhostSnapshot, nil
+	}
+
+	return nil, fmt.Errorf(vhostNotInSnapshotError, key.vhost, key.source())
+}
+
+// source returns the backend and cluster of the key, used in the logs (ex: rabbitmq/default)
+func (key snapshotKey) source() string {
+	return key.backend + "/" + key.cluster
+}
+
+// fetch updates the queue with the snapshot, a pattern is matched against all the queues of the vhost
+func (snapshot *queueSnapshot) fetch(queue *appQueue) error {
+	vhostSnapshot, err := snapshot.get(queue.snapshotKey())
+	if err != nil {
+		return err
+	}
+
+	if queue.pattern != nil {
+		matching := queue.pattern.filter(vhostSnapshot.queues)
+		if len(matching) == 0 {
+			return newSourceError(SourceNotFound, patternNotMatchedError, queue.name, queue.vhost)
+		}
+
+		queue.update(matching...)
+		klog.Infof("%s matches %d queues (messages: %d / consumers: %d)", queue.key(), queue.matches, queue.messages, queue.consumers)
+		return nil
+	}
+
+	info, ok := vhostSnapshot.byName[queue.name]
+	if !ok {
+		return newSourceError(SourceNotFound, queueNotFoundError, queue.name, queue.vhost)
+	}
+
+	queue.update(info)
+	return nil
+}
+
+// snapshotKeys returns the vhosts of the queues of the apps
+func snapshotKeys(apps []*App) []snapshotKey {
+	var keys []snapshotKey
+	seen := make(map[snapshotKey]bool)
+
+	for _, app := range apps {
+		for _, queue := range app.queues {
+			key := queue.snapshotKey()
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// staticSource a backend returning the same queues for every vhost
+type staticSource []*QueueStats
+
+func (s staticSource) ListQueues(ctx context.Context, vhost string) ([]*QueueStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, newSourceError(SourceUnavailable, "list queues of vhost %s: %s", vhost, err)
+	}
+	return s, nil
+}
+
+func TestQueueSource(t *testing.T) {
+	snapshots := newSnapshotter(queueSources{"static": {DefaultCluster: staticSource{{Name: "queue", Messages: 3, Consumers: 1}}}}, 0)
+	queue := &appQueue{backend: "static", vhost: "namespace", name: "queue"}
+
+	snapshot := snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); err != nil {
+		t.Error("Queue should be found", err)
+	}
+
+	if queue.messages != 3 || queue.consumers != 1 || queue.stats != nil {
+		t.Error("Expected 3 messages, 1 consumer and no rates, got ", queue.messages, queue.consumers, queue.stats)
+	}
+}
+
+// slowSource a backend that never answers before the context is done
+type slowSource struct{}
+
+func (s slowSource) ListQueues(ctx context.Context, vhost string) ([]*QueueStats, error) {
+	<-ctx.Done()
+	return nil, newSourceError(SourceUnavailable, "list queues of vhost %s: %s", vhost, ctx.Err())
+}
+
+func TestSlowSource(t *testing.T) {
+	snapshots := newSnapshotter(queueSources{"static": {
+		"slow":         slowSource{},
+		DefaultCluster: staticSource{{Name: "queue", Messages: 3, Consumers: 1}},
+	}}, 0)
+	snapshots.timeout = 50 * time.Millisecond
+
+	slow := &appQueue{backend: "static", cluster: "slow", vhost: "namespace", name: "queue"}
+	healthy := &appQueue{backend: "static", cluster: DefaultCluster, vhost: "namespace", name: "queue"}
+	keys := []snapshotKey{slow.snapshotKey(), healthy.snapshotKey()}
+
+	// The vhosts are listed one by one, then concurrently
+	for _, workers := range []int{1, 2} {
+		snapshots.workers = workers
+
+		ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+		start := time.Now()
+		snapshot := snapshots.refresh(ctx, keys)
+		cancel()
+
+		if err := snapshot.fetch(slow); errorKind(err) != SourceUnavailable {
+			t.Error("Slow source should be unavailable, got ", err)
+		}
+
+		if err := snapshot.fetch(healthy); err != nil || healthy.messages != 3 {
+			t.Error("Slow source should not fail the other vhosts, got ", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Error("Slow source should be bounded by its timeout, took ", elapsed)
+		}
+	}
+}
+
+func TestClusters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "clusters")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("secret\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "clusters.yml"), []byte(`
+clusters:
+- name: eu
+  url: https://rmq-eu:15671
+  user: autoscaler
+  passwordFile: `+filepath.Join(dir, "password")+`
+- name: us
+  url: https://rmq-us:15671
+  user: autoscaler
+  password: password
+`), 0600)
+
+	configs, err := loadClusters(filepath.Join(dir, "clusters.yml"))
+
+	if err != nil || len(configs) != 2 {
+		t.Fatal("Clusters should be loaded", err)
+	}
+
+	clusters, err := newClusters(configs, time.Second)
+
+	if err != nil {
+		t.Fatal("Clusters should be created", err)
+	}
+
+	if clusters["eu"].(*rmq).Password != "secret" {
+		t.Error("Password should be read from the file")
+	}
+
+	sources := queueSources{DefaultBackend: clusters}
+
+	if source, err := sources.get(DefaultBackend, "us"); err != nil || source != clusters["us"] {
+		t.Error("Cluster us should be found", err)
+	}
+
+	if _, err := sources.get(DefaultBackend, "asia"); err == nil || err.Error() != "cluster asia is not configured for backend rabbitmq" {
+		t.Error("Unknown cluster should fail", err)
+	}
+
+	if _, err := sources.get(DefaultBackend, DefaultCluster); err == nil || err.Error() != "no default cluster configured for backend rabbitmq, set the `cluster` annotation" {
+		t.Error("Missing default cluster should fail", err)
+	}
+
+	if _, err := newClusters(append(configs, configs[0]), time.Second); err == nil {
+		t.Error("Duplicated cluster should fail")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	defer func(backoff time.Duration) { rmqRetryBackoff = backoff }(rmqRetryBackoff)
+	rmqRetryBackoff = time.Millisecond
+
+	calls := 0
+	available := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if !available {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.URL.Path != "/api/queues/vhost" {
+			t.Error("Unexpected path ", r.URL.Path)
+		}
+
+		if r.URL.Query().Get("columns") == "" {
+			t.Error("Columns should be filtered")
+		}
+
+		w.Write([]byte(`[
+			{"name": "queue", "consumers": 2, "messages": 5, "message_stats": {"publish_details": {"rate": 1.5}}},
+			{"name": "orders.shard-0", "consumers": 1, "messages": 3},
+			{"name": "orders.shard-1", "consumers": 1, "messages": 4}
+		]`))
+	}))
+	defer server.Close()
+
+	rmq, _ := newRmq(server.URL, "user", "password", server.Client())
+	snapshots := newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: rmq}}, time.Minute)
+	vhost := snapshotKey{backend: DefaultBackend, vhost: "vhost"}
+
+	snapshot := snapshots.refresh(context.Background(), []snapshotKey{vhost, {backend: "unknown", vhost: "vhost"}})
+
+	queue := &appQueue{backend: DefaultBackend, vhost: "vhost", name: "queue"}
+	pattern, _ := parseQueuePattern("test", "orders.shard-*")
+	shards := &appQueue{backend: DefaultBackend, vhost: "vhost", name: "orders.shard-*", pattern: pattern}
+
+	if err := snapshot.fetch(queue); err != nil {
+		t.Error("Queue should be found", err)
+	}
+
+	if err := snapshot.fetch(shards); err != nil {
+		t.Error("Pattern should be resolved", err)
+	}
+
+	if calls != 1 {
+		t.Error("Expected 1 call, got ", calls)
+	}
+
+	if queue.messages != 5 || queue.consumers != 2 {
+		t.Error("Expected 5 messages and 2 consumers, got ", queue.messages, queue.consumers)
+	}
+
+	if rate, _ := queue.stats.publishRate(); rate != 1.5 {
+		t.Error("Expected a publish rate of 1.5, got ", rate)
+	}
+
+	if shards.messages != 7 || shards.consumers != 2 {
+		t.Error("Expected 7 messages and 2 consumers, got ", shards.messages, shards.consumers)
+	}
+
+	if err := snapshot.fetch(&appQueue{backend: DefaultBackend, vhost: "vhost", name: "missing"}); err == nil || err.Error() != "queue missing not found on vhost vhost" {
+		t.Error("Missing queue should fail", err)
+	}
+
+	unmatched, _ := parseQueuePattern("test", "payments.shard-*")
+	if err := snapshot.fetch(&appQueue{backend: DefaultBackend, vhost: "vhost", name: "payments.shard-*", pattern: unmatched}); errorKind(err) != SourceNotFound || err.Error() != "no queue matches payments.shard-* on vhost vhost" {
+		t.Error("Pattern matching no queue should fail", err)
+	}
+
+	if err := snapshot.fetch(&appQueue{backend: DefaultBackend, vhost: "other", name: "queue"}); err == nil {
+		t.Error("Vhost not in the snapshot should fail")
+	}
+
+	if err := snapshot.fetch(&appQueue{backend: "unknown", vhost: "vhost", name: "queue"}); err == nil || err.Error() != "backend unknown is not configured" {
+		t.Error("Unknown backend should fail", err)
+	}
+
+	// RabbitMQ is down, the last snapshot is still young enough
+	available = false
+	snapshot = snapshots.refresh(context.Background(), []snapshotKey{vhost})
+
+	if err := snapshot.fetch(queue); err != nil {
+		t.Error("Last snapshot should be used", err)
+	}
+
+	snapshots.last[vhost].fetchedAt = time.Now().Add(-2 * time.Minute)
+	snapshot = snapshots.refresh(context.Background(), []snapshotKey{vhost})
+
+	if err := snapshot.fetch(queue); err == nil {
+		t.Error("Last snapshot is too old and should not be used")
+	}
+
+	// Unused vhosts are forgotten
+	snapshots.refresh(context.Background(), nil)
+
+	if len(snapshots.last) != 0 {
+		t.Error("Unused vhosts should be forgotten")
+	}
+}
+
+func secret(user string, password string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"type": CredentialsSecretType,
+		"data": map[string]interface{}{
+			"username": base64.StdEncoding.EncodeToString([]byte(user)),
+			"password": base64.StdEncoding.EncodeToString([]byte(password)),
+		},
+	}}
+}
+
+func TestCredentialsSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+
+		if user != "monitoring" || password != "rotated" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`[{"name": "queue", "consumers": 1, "messages": 2}]`))
+	}))
+	defer server.Close()
+
+	rmq, _ := newRmq(server.URL, "admin", "admin", server.Client())
+	snapshots := newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: rmq}}, 0)
+	queue := &appQueue{backend: DefaultBackend, cluster: DefaultCluster, credentials: "namespace/rmq", vhost: "vhost", name: "queue"}
+
+	snapshot := snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); err == nil || err.Error() != "credentials secret namespace/rmq can't be used, the credentials secrets are not watched" {
+		t.Error("Secrets not watched should fail", err)
+	}
+
+	snapshots.credentials = newCredentialsStore()
+	snapshot = snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); err == nil || err.Error() != "credentials secret namespace/rmq not found, or not a kubernetes.io/basic-auth secret with username and password" {
+		t.Error("Missing secret should fail", err)
+	}
+
+	snapshots.credentials.handler("namespace/rmq", secret("monitoring", "password"))
+	snapshot = snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); err == nil {
+		t.Error("Wrong password should fail")
+	}
+
+	// The password is rotated without recreating the app
+	snapshots.credentials.handler("namespace/rmq", secret("monitoring", "rotated"))
+	snapshot = snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); err != nil || queue.messages != 2 {
+		t.Error("Secret credentials should be used", err)
+	}
+
+	if rmq.User != "admin" {
+		t.Error("Cluster credentials should not change, got ", rmq.User)
+	}
+
+	snapshots.credentials.handler("namespace/rmq", nil)
+
+	if _, err := snapshots.credentials.get("namespace/rmq"); err == nil {
+		t.Error("Deleted secret should be forgotten")
+	}
+}
+
+// writeCertificate writes a self signed certificate and its key, usable as a CA and as a client certificate
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "k8s-rmq-autoscaler"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	certificate, _ := x509.ParseCertificate(der)
+	return certFile, keyFile, certificate
+}
+
+func TestTLS(t *testing.T) {
+	defer func(backoff time.Duration) { rmqRetryBackoff = backoff }(rmqRetryBackoff)
+	rmqRetryBackoff = time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, clientCA := writeCertificate(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mtls vhost requires a client certificate
+		if r.URL.Path == "/api/queues/mtls" && len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`[{"name": "queue", "consumers": 1, "messages": 2}]`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	list := func(options tlsOptions, vhost ...string) error {
+		clusters, err := newClusters([]clusterConfig{{Name: DefaultCluster, URL: server.URL, User: "user", Password: "password", TLS: options}}, time.Second)
+		if err != nil {
+			return err
+		}
+
+		_, err = clusters[DefaultCluster].ListQueues(context.Background(), append(vhost, "vhost")[0])
+		return err
+	}
+
+	if err := list(tlsOptions{}); err == nil {
+		t.Error("Unknown CA should fail")
+	}
+
+	if err := list(tlsOptions{CAFile: caFile}); err != nil {
+		t.Error("CA file should be trusted", err)
+	}
+
+	if err := list(tlsOptions{CAFile: caFile, ServerName: "example.com"}); err != nil {
+		t.Error("Server name of the certificate should be accepted", err)
+	}
+
+	if err := list(tlsOptions{CAFile: caFile, ServerName: "rabbitmq.local"}); err == nil {
+		t.Error("Wrong server name should fail")
+	}
+
+	if err := list(tlsOptions{InsecureSkipVerify: true}); err != nil {
+		t.Error("Insecure skip verify should not check the certificate", err)
+	}
+
+	if err := list(tlsOptions{CAFile: certFile + ".missing"}); err == nil {
+		t.Error("Missing CA file should fail")
+	}
+
+	if err := list(tlsOptions{CAFile: caFile, CertFile: certFile}); err == nil {
+		t.Error("Client certificate without key should fail")
+	}
+
+	// Mutual TLS
+	if err := list(tlsOptions{CAFile: caFile}, "mtls"); err == nil {
+		t.Error("Missing client certificate should fail")
+	}
+
+	if err := list(tlsOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, "mtls"); err != nil {
+		t.Error("Client certificate should be accepted", err)
+	}
+}
+
+func TestRmqErrors(t *testing.T) {
+	defer func(backoff time.Duration) { rmqRetryBackoff = backoff }(rmqRetryBackoff)
+	rmqRetryBackoff = time.Millisecond
+
+	failures := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/queues/%2F", "/api/queues/my%20vhost":
+			w.Write([]byte(`[{"name": "queue", "consumers": 1, "messages": 2}]`))
+		case "/api/queues/flaky":
+			if failures++; failures <= rmqRetries {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`[]`))
+		case "/api/queues/down":
+			failures++
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/api/queues/private":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/api/queues/invalid":
+			w.Write([]byte(`{"error":`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	rmq, _ := newRmq(server.URL, "user", "password", server.Client())
+
+	for _, vhost := range []string{"/", "%2F", "my vhost"} {
+		if queues, err := rmq.ListQueues(context.Background(), vhost); err != nil || len(queues) != 1 {
+			t.Error("Vhost should be escaped ", vhost, err)
+		}
+	}
+
+	if _, err := rmq.ListQueues(context.Background(), "flaky"); err != nil || failures != rmqRetries+1 {
+		t.Error("Unavailable errors should be retried, got ", failures, err)
+	}
+
+	failures = 0
+
+	if _, err := rmq.ListQueues(context.Background(), "down"); errorKind(err) != SourceUnavailable || failures != rmqRetries+1 {
+		t.Error("Expected an unavailable error after the retries, got ", failures, err)
+	}
+
+	if _, err := rmq.ListQueues(context.Background(), "private"); errorKind(err) != SourceAuthFailed {
+		t.Error("Expected an auth error, got ", err)
+	}
+
+	if _, err := rmq.ListQueues(context.Background(), "missing"); errorKind(err) != SourceNotFound || err.Error() != "vhost missing not found" {
+		t.Error("Expected a not found error, got ", err)
+	}
+
+	if _, err := rmq.ListQueues(context.Background(), "invalid"); errorKind(err) != SourceUnavailable {
+		t.Error("Expected an unavailable error, got ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := rmq.ListQueues(ctx, "/"); errorKind(err) != SourceUnavailable {
+		t.Error("Expected an unavailable error, got ", err)
+	}
+
+	// The last snapshot is only used when RabbitMQ is unavailable
+	snapshots := newSnapshotter(queueSources{DefaultBackend: {DefaultCluster: rmq}}, time.Minute)
+	key := snapshotKey{backend: DefaultBackend, vhost: "private"}
+	snapshots.last[key] = newVhostSnapshot(nil)
+
+	if snapshot := snapshots.refresh(context.Background(), []snapshotKey{key}); errorKind(snapshot.errors[key]) != SourceAuthFailed {
+		t.Error("Last snapshot should not be used when the credentials are refused")
+	}
+
+	queue := &appQueue{backend: DefaultBackend, vhost: "/", name: "missing"}
+	snapshot := snapshots.refresh(context.Background(), []snapshotKey{queue.snapshotKey()})
+
+	if err := snapshot.fetch(queue); queueErrorReason(err) != QueueNotFoundReason {
+		t.Error("Expected a QueueNotFound reason, got ", err)
+	}
+}
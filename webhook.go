@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+// webhook validating admission webhook that rejects the workloads and RabbitScalers with an invalid configuration.
+// The backends and clusters are checked against the configured sources
+type webhook struct {
+	sources queueSources
+}
+
+// serveWebhook serves the validating admission webhook on /validate
+func serveWebhook(address string, certFile string, keyFile string, sources queueSources) {
+	mux := http.NewServeMux()
+	mux.Handle("/validate", &webhook{sources: sources})
+
+	klog.Infof("Serving admission webhook on %s/validate", address)
+	if err := http.ListenAndServeTLS(address, certFile, keyFile, mux); err != nil {
+		klog.Errorf("Admission webhook server stopped (%s)", err)
+	}
+}
+
+func (wh *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := &v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review (%v)", err), http.StatusBadRequest)
+		return
+	}
+
+	// admission.k8s.io/v1 and v1beta1 share the same schema, answer with the version of the request
+	review.Response = wh.validate(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	response, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// validate runs the createApp parsing and semantic checks on the admitted object
+func (wh *webhook) validate(request *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	object := &unstructured.Unstructured{}
+
+	if err := object.UnmarshalJSON(request.Object.Raw); err != nil {
+		return deny(err)
+	}
+
+	// The namespace is not always filled on creation
+	object.SetNamespace(request.Namespace)
+
+	resource := schema.GroupVersionResource{
+		Group:    request.Resource.Group,
+		Version:  request.Resource.Version,
+		Resource: request.Resource.Resource,
+	}
+
+	target := newWorkload(resource, object)
+
+	if resource.GroupResource() == RabbitScalersResource.GroupResource() {
+		scaler, err := newRabbitScaler(object)
+		if err != nil {
+			return deny(err)
+		}
+		target.annotations = scaler.annotations()
+	}
+
+	// The workloads managed by a controller are not autoscaled, their creation by the controller must not be blocked
+	if !isEnabled(target) || len(target.controller) > 0 {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	app, err := createApp(target, target.key())
+
+	if err == nil {
+		err = wh.sources.check(app)
+	}
+
+	if err != nil {
+		klog.Infof("Rejecting %s (%s)", target.key(), err)
+		return deny(err)
+	}
+
+	return &v1beta1.AdmissionResponse{Allowed: true}
+}
+
+func deny(err error) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func review(t *testing.T, server *httptest.Server, annotations map[string]string) *v1beta1.AdmissionResponse {
+	object, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":        "worker",
+			"annotations": annotations,
+		},
+		"spec": map[string]interface{}{
+			"replicas": 1,
+		},
+	})
+
+	body, _ := json.Marshal(&v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "uid",
+			Namespace: "namespace",
+			Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	})
+
+	resp, err := server.Client().Post(server.URL+"/validate", "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		t.Fatal("Webhook should answer", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected 200, got ", resp.StatusCode)
+	}
+
+	result := &v1beta1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal("Response should be an admission review", err)
+	}
+
+	if result.APIVersion != "admission.k8s.io/v1" {
+		t.Error("Response should have the request version, got ", result.APIVersion)
+	}
+	if result.Response.UID != "uid" {
+		t.Error("Response should have the request uid, got ", result.Response.UID)
+	}
+
+	return result.Response
+}
+
+func TestWebhook(t *testing.T) {
+	server := httptest.NewTLSServer(&webhook{sources: queueSources{DefaultBackend: {DefaultCluster: staticSource{}}}})
+	defer server.Close()
+
+	// Not concerned by autoscaling
+	response := review(t, server, map[string]string{})
+
+	if !response.Allowed {
+		t.Error("Deployment without annotations should be allowed")
+	}
+
+	annotations := map[string]string{
+		"k8s-rmq-autoscaler/enable":      "true",
+		"k8s-rmq-autoscaler/queue":       "queue",
+		"k8s-rmq-autoscaler/vhost":       "vhost",
+		"k8s-rmq-autoscaler/min-workers": "1",
+		"k8s-rmq-autoscaler/max-workers": "2",
+		// The activation workers are only checked with scale to zero
+		"k8s-rmq-autoscaler/scale-to-zero": "true",
+	}
+
+	response = review(t, server, annotations)
+
+	if !response.Allowed {
+		t.Error("Valid deployment should be allowed", response.Result)
+	}
+
+	rejected := map[string]string{
+		"min-workers":         "3",
+		"steps":               "0",
+		"messages-per-worker": "0",
+		"cooldown-delay":      "5",
+		"override":            "nope",
+		"scale-to-zero":       "maybe",
+		"rate-per-worker":     "fast",
+		"target-drain-time":   "0s",
+		"queue-pattern":       "orders[",
+		"backend":             "",
+		"cluster":             "",
+		"credentials-secret":  "",
+		"dry-run":             "maybe",
+		"paused":              "maybe",
+		"failure-policy":      "panic",
+		"failure-threshold":   "0",
+		"fallback-replicas":   "10",
+		"schedule":            "- {cron: never}",
+		"behavior":            "scaleDown: {selectPolicy: Always}",
+		"activation-workers":  "3",
+	}
+
+	for annotation, value := range rejected {
+		previous, found := annotations["k8s-rmq-autoscaler/"+annotation]
+		annotations["k8s-rmq-autoscaler/"+annotation] = value
+
+		response = review(t, server, annotations)
+
+		if response.Allowed {
+			t.Errorf("Deployment with %s=%s should be rejected", annotation, value)
+		} else if !strings.Contains(response.Result.Message, "deployments.apps/namespace/worker") || !strings.Contains(response.Result.Message, annotation) {
+			t.Error("Rejection message not right", response.Result.Message)
+		}
+
+		if found {
+			annotations["k8s-rmq-autoscaler/"+annotation] = previous
+		} else {
+			delete(annotations, "k8s-rmq-autoscaler/"+annotation)
+		}
+	}
+
+	// The cluster must be configured
+	annotations["k8s-rmq-autoscaler/cluster"] = "asia"
+
+	if response = review(t, server, annotations); response.Allowed || !strings.Contains(response.Result.Message, "cluster asia is not configured") {
+		t.Error("Deployment with an unknown cluster should be rejected", response.Result)
+	}
+
+	resp, err := server.Client().Get(server.URL + "/validate")
+
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Only POST should be allowed")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/scale"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// DefaultResources Resources watched by default, formatted as `resource.version.group`
+	DefaultResources = "deployments.v1.apps,statefulsets.v1.apps,replicasets.v1.apps"
+
+	invalidResourceError = "resource `%s` is not valid, expected `resource.version.group` (ex: deployments.v1.apps)"
+)
+
+// workload a resource with a /scale subresource watched by the autoscaler
+type workload struct {
+	resource      schema.GroupVersionResource
+	object        runtime.Object
+	namespace     string
+	name          string
+	annotations   map[string]string
+	replicas      int32
+	readyReplicas int32
+	// controller kind/name of the controller owning the workload (ex: Deployment/worker), empty when not owned
+	controller string
+}
+
+// newWorkload reads the scaling information of an object.
+// Replicas are read from `spec.replicas` and ready replicas from `status.readyReplicas`
+func newWorkload(resource schema.GroupVersionResource, object *unstructured.Unstructured) *workload {
+	replicas, found, err := unstructured.NestedInt64(object.Object, "spec", "replicas")
+	if !found || err != nil {
+		// Kubernetes default value
+		replicas = 1
+	}
+
+	readyReplicas, _, _ := unstructured.NestedInt64(object.Object, "status", "readyReplicas")
+
+	var controller string
+	for _, owner := range object.GetOwnerReferences() {
+		if owner.Controller != nil && *owner.Controller {
+			controller = owner.Kind + "/" + owner.Name
+		}
+	}
+
+	return &workload{
+		resource:      resource,
+		object:        object,
+		namespace:     object.GetNamespace(),
+		name:          object.GetName(),
+		annotations:   object.GetAnnotations(),
+		replicas:      int32(replicas),
+		readyReplicas: int32(readyReplicas),
+		controller:    controller,
+	}
+}
+
+// key returns the unique key of the workload (ex: deployments.apps/namespace/name)
+func (w *workload) key() string {
+	return fmt.Sprintf("%s/%s/%s", w.resource.GroupResource().String(), w.namespace, w.name)
+}
+
+// scale updates the replicas of the workload through its /scale subresource.
+// Only the replicas are sent, the update is retried with a fresh scale on conflict until the context is done
+func (w *workload) scale(ctx context.Context, scaler scale.ScalesGetter, replicas int32) error {
+	resource := w.resource.GroupResource()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		current, err := scaler.Scales(w.namespace).Get(resource, w.name)
+		if err != nil {
+			return err
+		}
+
+		current.Spec.Replicas = replicas
+		_, err = scaler.Scales(w.namespace).Update(resource, current)
+		return err
+	})
+}
+
+// parseResources parses a list of resources separated by commas, each formatted as `resource.version.group`
+func parseResources(resources string) ([]schema.GroupVersionResource, error) {
+	var parsed []schema.GroupVersionResource
+
+	for _, resource := range strings.Split(resources, ",") {
+		resource = strings.TrimSpace(resource)
+
+		if len(resource) == 0 {
+			continue
+		}
+
+		gvr, _ := schema.ParseResourceArg(resource)
+
+		if gvr == nil {
+			return nil, fmt.Errorf(invalidResourceError, resource)
+		}
+
+		parsed = append(parsed, *gvr)
+	}
+
+	return parsed, nil
+}